@@ -0,0 +1,95 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-playground/validator/v10"
+)
+
+// AllAdminRoutes are the back-office routes. Support staff can look users up,
+// changing accounts is left to admins.
+func (a *application) AllAdminRoutes(r chi.Router) {
+	r.Use(a.AuthMiddleware)
+	r.Use(a.RequireRole(types.RoleSupport, types.RoleAdmin))
+	r.Get("/users", a.GetAllUsers)
+	r.Get("/users/{email}", a.GetUsersByEmail)
+	r.Get("/borrowers", a.GetAllBorrowers)
+
+	r.Group(func(r chi.Router) {
+		r.Use(a.RequireRole(types.RoleAdmin))
+		r.Put("/users/{id}/role", a.SetUserRole)
+		r.Post("/users/{id}/revoke-sessions", a.RevokeUserSessions)
+		r.Post("/accounts/{id}/recompute-balance", a.RecomputeAccountBalance)
+	})
+}
+
+func (a *application) SetUserRole(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var payload types.SetRoleDto
+
+	userId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid user id"))
+		return
+	}
+
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	if err := a.store.Users.SetRole(ctx, userId, payload.Role); err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, fmt.Sprintf("Role set to %s", payload.Role))
+}
+
+func (a *application) RevokeUserSessions(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	userId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid user id"))
+		return
+	}
+
+	if err := a.store.Auth.RevokeUserSessions(ctx, userId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Sessions revoked")
+}
+
+// RecomputeAccountBalance rebuilds the cached balance of an account from its
+// ledger postings.
+func (a *application) RecomputeAccountBalance(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	accountId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid account id"))
+		return
+	}
+
+	balance, err := a.store.Ledger.RecomputeBalance(ctx, accountId)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, balance)
+}
@@ -1,14 +1,17 @@
 package api
 
 import (
+	"context"
 	"database/sql"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
+	"github.com/brownei/chifunds-api/mailer"
 	"github.com/brownei/chifunds-api/store"
-	"github.com/brownei/chifunds-api/types"
 	"github.com/brownei/chifunds-api/utils"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -20,28 +23,30 @@ import (
 	"go.uber.org/zap"
 )
 
+// allowedOrigins are the web apps allowed to call the API from a browser.
+var allowedOrigins = []string{"http://localhost:3000", "http://localhost:5173", "https://chifunds.vercel.app"}
+
 type application struct {
 	addr         string
 	db           *sql.DB
 	sessionStore *sessions.CookieStore
 	store        store.Store
 	logger       *zap.SugaredLogger
-	sseChannel   *types.SSEChannel
+	hub          *Hub
+	mailer       mailer.Mailer
+	keys         *KeyManager
 }
 
 func NewServer(addr string, logger *zap.SugaredLogger, db *sql.DB, store store.Store) *application {
-	sseChannel := &types.SSEChannel{
-		Notifier: make(chan string),
-		Clients:  make([]chan string, 0),
-	}
-
 	return &application{
 		addr:         addr,
 		db:           db,
 		store:        store,
 		sessionStore: sessions.NewCookieStore([]byte(os.Getenv("SECRET_KEY"))),
 		logger:       logger,
-		sseChannel:   sseChannel,
+		hub:          NewHub(),
+		mailer:       mailer.New(logger),
+		keys:         NewKeyManager(store, logger),
 	}
 }
 
@@ -56,57 +61,94 @@ func (a *application) Run() error {
 	// A good base middleware stack
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
+	r.Use(a.QueryTokenMiddleware)
 	r.Use(middleware.Logger)
 	r.Use(middleware.Recoverer)
 	r.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   []string{"http://localhost:3000", "http://localhost:5173", "https://chifunds.vercel.app"},
+		AllowedOrigins:   allowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Authorization", "Content-Type"},
+		AllowedHeaders:   []string{"Authorization", "Content-Type", "Idempotency-Key", utils.ClientPublicKeyHeader, PayloadEncryptionHeader},
+		ExposedHeaders:   []string{"Idempotent-Replayed", PayloadEncryptionHeader},
 		AllowCredentials: true,
 		MaxAge:           300, // Maximum value not to preflight requests repeatedly
 		Debug:            true,
 	}))
-	// Set a timeout value on the request context (ctx), that will signal
-	// through ctx.Done() that the request has timed out and further
-	// processing should be stopped.
-	r.Use(middleware.Timeout(60 * time.Second))
 
 	//All the new handlers
 	r.Route("/v1", func(r chi.Router) {
-
-		r.Get("/balance", SseRoute)
-
-		r.Get("/", func(w http.ResponseWriter, r *http.Request) {
-			message := "ChiFunds Api"
-			utils.WriteJSON(w, http.StatusOK, message)
-		})
+		// Streams stay open for as long as the client listens, so they are
+		// kept out of the group with the request timeout below.
+		r.With(a.StreamAuthMiddleware).Get("/balance", a.SseRoute)
+		r.With(a.StreamAuthMiddleware).Get("/ws", a.WebSocketRoute)
 
 		r.Group(func(r chi.Router) {
-			r.Use(a.PublicKeyMiddleware)
-			r.Get("/all-keys", a.GetAllKeysHandler)
+			// Set a timeout value on the request context (ctx), that will signal
+			// through ctx.Done() that the request has timed out and further
+			// processing should be stopped.
+			r.Use(middleware.Timeout(60 * time.Second))
+
+			r.Get("/", func(w http.ResponseWriter, r *http.Request) {
+				message := "ChiFunds Api"
+				utils.WriteJSON(w, http.StatusOK, message)
+			})
+
+			r.Get("/.well-known/jwks.json", a.GetJWKS)
+
+			r.Route("/admin", a.AllAdminRoutes)
+			r.Route("/transactions", a.AllTransactionRoutes)
+			r.Route("/loans", a.AllLoanRoutes)
+			r.Route("/cards", a.AllCardRoutes)
+			r.Route("/card-authorizations", a.AllCardAuthorizationRoutes)
+			r.Route("/auth", a.AllAuthRoutes)
 		})
-
-		r.Route("/users", a.AllUsersRoutes)
-		r.Route("/transactions", a.AllTransactionRoutes)
-		r.Route("/auth", a.AllAuthRoutes)
 	})
 
-	log.Printf("Listening on %s", a.addr)
-	return http.ListenAndServe(a.addr, r)
-}
+	if utils.LegacyEncryption() {
+		a.logger.Warn("LEGACY_PAYLOAD_ENCRYPTION is on: legacy payloads have no replay protection, routes that move money still refuse them")
+	}
 
-func (a *application) CreateChiFundsUser() error {
-	creatingNewUserQuery := `INSERT INTO "user" (email, first_name, last_name, profile_picture, password, email_verified) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, email, first_name, last_name, profile_picture, email_verified`
+	if err := a.keys.Load(context.Background()); err != nil {
+		return err
+	}
+	go a.keys.refreshKeys()
+	go a.pruneNonces()
+
+	events, stopEvents := context.WithCancel(context.Background())
+	defer stopEvents()
 
-	_, err := a.db.Query(creatingNewUserQuery, "chifundsadmin@gmail.com", "ChiFunds", "Funding", "", "sfhkbhagassvnldfhdgklhdhguytigndnb", true)
+	relayed, err := a.ListenForEvents(events)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil
-		}
+		return err
+	}
+	go a.pruneEvents()
+
+	server := &http.Server{Addr: a.addr, Handler: r}
+	// The relay stops before the hub closes, so nothing is delivered into a
+	// closed hub.
+	server.RegisterOnShutdown(func() {
+		stopEvents()
+		<-relayed
+		a.hub.Close()
+	})
+
+	// On SIGINT or SIGTERM stop accepting requests and close every stream,
+	// then give the requests in flight a moment to finish.
+	shutdown := make(chan error, 1)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		<-signals
 
+		log.Printf("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+		defer cancel()
+		shutdown <- server.Shutdown(ctx)
+	}()
+
+	log.Printf("Listening on %s", a.addr)
+	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		return err
 	}
 
-	log.Printf("Admin user created!")
-	return nil
+	return <-shutdown
 }
@@ -2,10 +2,15 @@ package api
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"net/url"
+	"time"
 
+	"github.com/brownei/chifunds-api/store"
 	"github.com/brownei/chifunds-api/types"
 	"github.com/brownei/chifunds-api/utils"
 	"github.com/go-chi/chi/v5"
@@ -17,8 +22,19 @@ func (a *application) AllAuthRoutes(r chi.Router) {
 	r.Group(func(r chi.Router) {
 		r.Use(a.AuthMiddleware)
 		r.Get("/user", a.GetCurrentUser)
+		r.Post("/logout", a.Logout)
+		r.Post("/verify-email/resend", a.ResendVerificationEmail)
+		r.Post("/2fa/enroll", a.EnrollTotp)
+		r.Post("/2fa/confirm", a.ConfirmTotp)
+		r.Post("/2fa/disable", a.DisableTotp)
 	})
+	r.Get("/verify-email", a.VerifyEmail)
+	r.Get("/unlock", a.UnlockAccount)
 	r.Post("/signin", a.Login)
+	r.Post("/signin/2fa", a.TwoFactorSignIn)
+	r.Post("/refresh", a.RefreshSession)
+	r.Post("/forgot-password", a.ForgotPassword)
+	r.Post("/reset-password", a.ResetPassword)
 	r.Post("/signup", a.CreateAUser)
 	r.Get("/{provider}", a.GoogleAuthLoginAndRegister)
 	r.Get("/{provider}/callback", a.ProviderAuthCallbackFunction)
@@ -27,13 +43,11 @@ func (a *application) AllAuthRoutes(r chi.Router) {
 func (a *application) GetCurrentUser(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	email := ctx.Value("user").(string)
-	a.logger.Infof("Current user email: %s", email)
 
 	existingUSer, err := a.store.Users.GetUsersByEmail(ctx, email, true)
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 	} else if existingUSer == nil {
-		a.logger.Infof("Current user email: %v", existingUSer)
 		utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("No user like this found"))
 	}
 
@@ -66,13 +80,12 @@ func (a *application) CreateAUser(w http.ResponseWriter, r *http.Request) {
 
 	//Check if user exists first
 	existingUser, err := a.store.Users.GetUsersByEmail(ctx, payload.Email, false)
-	log.Printf("existingUser: %v\n", existingUser)
 	if existingUser != nil {
 		utils.WriteError(w, http.StatusFound, fmt.Errorf("User already exists"))
 		return
 	}
 
-	_, err = a.store.Users.CreateNewUser(ctx, types.RegisterUserPayload{
+	user, err := a.store.Users.CreateNewUser(ctx, types.RegisterUserPayload{
 		Email:          payload.Email,
 		FirstName:      payload.FirstName,
 		Password:       payload.Password,
@@ -85,9 +98,24 @@ func (a *application) CreateAUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	token := utils.JwtToken(payload.Email, ctx)
-	log.Printf("Token: %s", token)
-	utils.WriteJSON(w, http.StatusCreated, token)
+	tokens, err := a.store.Auth.CreateSession(ctx, user.ID, user.Email)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// A slow mail server should not hold up the sign up, the user can ask for
+	// another email if this one never arrives.
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		if err := a.sendVerificationEmail(ctx, user); err != nil {
+			a.logger.Errorf("Could not send verification email to user %d: %v", user.ID, err)
+		}
+	}()
+
+	utils.WriteJSON(w, http.StatusCreated, tokens)
 }
 
 func (a *application) ProviderAuthCallbackFunction(w http.ResponseWriter, r *http.Request) {
@@ -103,7 +131,7 @@ func (a *application) ProviderAuthCallbackFunction(w http.ResponseWriter, r *htt
 				utils.WriteError(w, http.StatusBadRequest, err)
 			}
 
-			_, err = a.store.Users.CreateNewUser(ctx, types.RegisterUserPayload{
+			user, err := a.store.Users.CreateNewUser(ctx, types.RegisterUserPayload{
 				Email:          gothUser.Email,
 				FirstName:      gothUser.FirstName,
 				LastName:       gothUser.LastName,
@@ -111,29 +139,49 @@ func (a *application) ProviderAuthCallbackFunction(w http.ResponseWriter, r *htt
 				Password:       hashedPassword,
 				EmailVerified:  true,
 			})
+			if err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
 
-			token := utils.JwtToken(gothUser.Email, ctx)
-			response := fmt.Sprintf(`
-        <script>
-            window.opener.postMessage({ token: "%s" }, "*");
-            window.close();
-        </script>
-    `, token)
-			//a.logger.Info(token)
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(response))
+			tokens, err := a.store.Auth.CreateSession(ctx, user.ID, user.Email)
+			if err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			writeOpenerMessage(w, map[string]any{"token": tokens.AccessToken, "refreshToken": tokens.RefreshToken})
 		} else if existingUSer != nil {
-			token := utils.JwtToken(existingUSer.Email, ctx)
-			//utils.WriteJSON(w, http.StatusOK, token)
+			// The provider only stands in for the password: locked and
+			// throttled accounts wait like they do for a password, and users
+			// with two-factor authentication still answer the challenge.
+			attempt := types.LoginAttempt{Email: existingUSer.Email, IP: clientIP(r), UserAgent: r.UserAgent()}
 
-			response := fmt.Sprintf(`
-        <script>
-            window.opener.postMessage({ token: "%s" }, "*");
-            window.close();
-        </script>
-    `, token)
-			w.Header().Set("Content-Type", "text/html")
-			w.Write([]byte(response))
+			throttle, err := a.store.LoginAttempts.CheckLoginAllowed(ctx, attempt.Email, attempt.IP)
+			if err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, err)
+				return
+			} else if throttle != nil {
+				writeLoginThrottle(w, throttle)
+				return
+			}
+
+			tokens, challenge, err := a.store.Auth.SignIn(ctx, existingUSer)
+			if err != nil {
+				utils.WriteError(w, http.StatusInternalServerError, err)
+				return
+			}
+
+			if challenge != nil {
+				writeOpenerMessage(w, map[string]any{"twoFactorRequired": true, "challengeToken": challenge.ChallengeToken, "expiresIn": challenge.ExpiresIn})
+				return
+			}
+
+			if err := a.store.LoginAttempts.RecordLoginSuccess(ctx, existingUSer.ID, attempt); err != nil {
+				a.logger.Errorf("Could not record sign in of user %d: %v", existingUSer.ID, err)
+			}
+
+			writeOpenerMessage(w, map[string]any{"token": tokens.AccessToken, "refreshToken": tokens.RefreshToken})
 
 		}
 
@@ -142,20 +190,192 @@ func (a *application) ProviderAuthCallbackFunction(w http.ResponseWriter, r *htt
 	}
 }
 
+// frontendOrigin is the origin of the web app, the only page the provider
+// sign in popup hands its tokens to.
+func frontendOrigin() string {
+	address, err := url.Parse(frontendURL())
+	if err != nil || address.Scheme == "" || address.Host == "" {
+		return frontendURL()
+	}
+
+	return address.Scheme + "://" + address.Host
+}
+
+// writeOpenerMessage answers the provider sign in popup with a page that
+// posts message to the web app that opened it, and closes. The message is
+// only delivered when the opener is on the web app's origin, no other page
+// that opened the popup gets the tokens.
+func writeOpenerMessage(w http.ResponseWriter, message map[string]any) {
+	data, err := json.Marshal(message)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	origin, err := json.Marshal(frontendOrigin())
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	response := fmt.Sprintf(`
+        <script>
+            window.opener.postMessage(%s, %s);
+            window.close();
+        </script>
+    `, data, origin)
+	w.Header().Set("Content-Type", "text/html")
+	w.Write([]byte(response))
+}
+
 func (a *application) Login(w http.ResponseWriter, r *http.Request) {
 	var loginPayload types.LoginPayload
 	ctx := r.Context()
 	if err := utils.ParseJSON(r, &loginPayload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
+		return
 	}
+
+	attempt := types.LoginAttempt{Email: loginPayload.Email, IP: clientIP(r), UserAgent: r.UserAgent()}
+
+	throttle, err := a.store.LoginAttempts.CheckLoginAllowed(ctx, attempt.Email, attempt.IP)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	} else if throttle != nil {
+		writeLoginThrottle(w, throttle)
+		return
+	}
+
 	existingUser, err := a.store.Users.GetUsersByEmail(ctx, loginPayload.Email, true)
+	if err != nil || existingUser == nil {
+		attempt.Reason = "unknown_email"
+		a.recordLoginFailure(ctx, attempt, nil)
+
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("No user like this exists"))
+		return
+	}
+
+	tokens, challenge, err := a.store.Auth.Login(ctx, existingUser, loginPayload)
 	if err != nil {
+		if errors.Is(err, store.ErrInvalidCredentials) {
+			attempt.Reason = "invalid_password"
+			a.recordLoginFailure(ctx, attempt, existingUser)
+		}
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	// The failures are only cleared once the second factor is answered too,
+	// so the lockout also covers guessing it.
+	if challenge != nil {
+		utils.WriteJSON(w, http.StatusAccepted, challenge)
+		return
+	}
+
+	if err := a.store.LoginAttempts.RecordLoginSuccess(ctx, existingUser.ID, attempt); err != nil {
+		a.logger.Errorf("Could not record sign in of user %d: %v", existingUser.ID, err)
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, tokens)
+}
+
+// TwoFactorSignIn completes a sign in challenge with a code from the user's
+// authenticator app or one of their recovery codes.
+func (a *application) TwoFactorSignIn(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var payload types.TwoFactorSignInDto
+
+	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
-	} else if existingUser == nil {
-		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("No user like this exists"))
+		return
 	}
 
-	token, err := a.store.Auth.Login(ctx, existingUser, loginPayload)
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	// The account's own lock is checked with the challenge, the address is
+	// throttled here like it is for passwords.
+	throttle, err := a.store.LoginAttempts.CheckLoginAllowed(ctx, "", clientIP(r))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	} else if throttle != nil {
+		writeLoginThrottle(w, throttle)
+		return
+	}
+
+	tokens, email, err := a.store.Auth.CompleteTwoFactorSignIn(ctx, payload.ChallengeToken, payload.Code)
+	if email == "" {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	attempt := types.LoginAttempt{Email: email, IP: clientIP(r), UserAgent: r.UserAgent()}
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+
+	if err != nil {
+		var codedErr *types.CodedError
+		if errors.As(err, &codedErr) && codedErr.Code == types.ErrorInvalidTwoFactorCode {
+			attempt.Reason = "invalid_second_factor"
+			a.recordLoginFailure(ctx, attempt, existingUser)
+		}
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	if existingUser != nil {
+		if err := a.store.LoginAttempts.RecordLoginSuccess(ctx, existingUser.ID, attempt); err != nil {
+			a.logger.Errorf("Could not record sign in of user %d: %v", existingUser.ID, err)
+		}
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, tokens)
+}
+
+// RefreshSession trades a refresh token for new tokens. The refresh token
+// can only be used once, the response carries its replacement.
+func (a *application) RefreshSession(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var payload types.RefreshTokenDto
+
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	tokens, err := a.store.Auth.RefreshSession(ctx, payload.RefreshToken)
+	if err != nil {
+		utils.WriteError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, tokens)
+}
+
+// Logout revokes the current session, its access and refresh tokens stop
+// working right away.
+func (a *application) Logout(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	sessionId := ctx.Value("session").(int64)
+
+	if err := a.store.Auth.Logout(ctx, sessionId); err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	utils.WriteJSON(w, http.StatusAccepted, token)
+	utils.WriteJSON(w, http.StatusOK, "Logged out")
 }
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-playground/validator/v10"
+)
+
+// AllCardAuthorizationRoutes is the merchant side of the simulated card
+// network. Merchants authorize a card payment, then capture or void it.
+func (a *application) AllCardAuthorizationRoutes(r chi.Router) {
+	r.Use(a.MerchantMiddleware)
+	r.Post("/", a.AuthorizeCard)
+	r.Get("/{id}", a.GetCardAuthorization)
+	r.Post("/{id}/capture", a.CaptureCardAuthorization)
+	r.Post("/{id}/void", a.VoidCardAuthorization)
+}
+
+func (a *application) AuthorizeCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var payload types.CardAuthorizationDto
+
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	authorization, err := a.store.CardAuthorizations.AuthorizeCard(ctx, payload)
+	if err != nil {
+		writeCardError(w, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, authorization)
+}
+
+func (a *application) GetCardAuthorization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	authorizationId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid authorization id"))
+		return
+	}
+
+	authorization, err := a.store.CardAuthorizations.GetAuthorization(ctx, authorizationId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, authorization)
+}
+
+func (a *application) CaptureCardAuthorization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var payload types.CaptureAuthorizationDto
+
+	authorizationId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid authorization id"))
+		return
+	}
+
+	// The body is optional, an empty one captures the full amount.
+	if r.ContentLength != 0 {
+		if err := utils.ParseJSON(r, &payload); err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	authorization, err := a.store.CardAuthorizations.CaptureAuthorization(ctx, a.logger, authorizationId, payload.Amount)
+	if err != nil {
+		writeCardError(w, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, authorization)
+}
+
+func (a *application) VoidCardAuthorization(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	authorizationId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid authorization id"))
+		return
+	}
+
+	authorization, err := a.store.CardAuthorizations.VoidAuthorization(ctx, authorizationId)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, authorization)
+}
+
+// writeCardError answers declines with 402 and their decline code, anything
+// else is a plain bad request.
+func writeCardError(w http.ResponseWriter, err error) {
+	var codedErr *types.CodedError
+	if errors.As(err, &codedErr) {
+		utils.WriteError(w, http.StatusPaymentRequired, err)
+		return
+	}
+
+	utils.WriteError(w, http.StatusBadRequest, err)
+}
@@ -0,0 +1,118 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/brownei/chifunds-api/utils"
+	"github.com/go-chi/chi/v5"
+)
+
+func (a *application) AllCardRoutes(r chi.Router) {
+	r.Use(a.AuthMiddleware)
+	r.Use(a.EncryptionMiddleware)
+	r.With(a.RequireVerifiedEmail).Post("/", a.IssueCard)
+	r.Get("/", a.GetCards)
+	r.Post("/{id}/freeze", a.FreezeCard)
+	r.Post("/{id}/unfreeze", a.UnfreezeCard)
+	r.Delete("/{id}", a.TerminateCard)
+}
+
+func (a *application) IssueCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	card, err := a.store.Cards.IssueCard(ctx, existingUser.ID)
+	if err != nil {
+		a.logger.Info(err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusCreated, card)
+}
+
+func (a *application) GetCards(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	cards, err := a.store.Cards.GetCards(ctx, existingUser.ID)
+	if err != nil {
+		a.logger.Info(err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, cards)
+}
+
+func (a *application) FreezeCard(w http.ResponseWriter, r *http.Request) {
+	a.setCardFrozen(w, r, true)
+}
+
+func (a *application) UnfreezeCard(w http.ResponseWriter, r *http.Request) {
+	a.setCardFrozen(w, r, false)
+}
+
+func (a *application) setCardFrozen(w http.ResponseWriter, r *http.Request, frozen bool) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	cardId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid card id"))
+		return
+	}
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	card, err := a.store.Cards.SetCardFrozen(ctx, existingUser.ID, cardId, frozen)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, card)
+}
+
+func (a *application) TerminateCard(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	cardId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid card id"))
+		return
+	}
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	card, err := a.store.Cards.TerminateCard(ctx, existingUser.ID, cardId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, card)
+}
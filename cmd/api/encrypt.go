@@ -1,28 +1,21 @@
 package api
 
 import (
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
 	"encoding/base64"
-	"encoding/pem"
 	"errors"
 	"fmt"
 	"io"
-	"net/http"
-	"os"
+	"time"
 
 	"github.com/brownei/chifunds-api/utils"
 	"golang.org/x/crypto/bcrypt"
 )
 
-type Key struct {
-	PublicKey  string `json:"publicKey"`
-	PrivateKey string `json:"privateKey"`
-}
-
 func HashPassword(password string) (string, error) {
 	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -32,17 +25,10 @@ func HashPassword(password string) (string, error) {
 	return string(hash), nil
 }
 
-func RsaEncrypt(origData []byte) (string, string, error) {
-	publicKey, err := os.ReadFile("public.pem")
-	block, _ := pem.Decode(publicKey)
-	if block == nil {
-		return "", "", errors.New("failed to parse public key PEM")
-	}
-
-	pubInterface, err := x509.ParsePKCS1PublicKey(block.Bytes)
-	if err != nil {
-		return "", "", fmt.Errorf("public key parsing error: %v", err)
-	}
+// RsaEncrypt seals a response in the legacy format, wrapping the AES key with
+// the server's current key. It is only used while legacy encryption is on.
+func (k *KeyManager) RsaEncrypt(origData []byte) (string, string, error) {
+	pubInterface := &k.currentKey().PublicKey
 
 	aesKey := make([]byte, 32) // Use AES-256 (32 bytes key)
 	if _, err := io.ReadFull(rand.Reader, aesKey); err != nil {
@@ -74,10 +60,13 @@ func RsaEncrypt(origData []byte) (string, string, error) {
 	return base64.StdEncoding.EncodeToString(encryptedData), base64.StdEncoding.EncodeToString(encryptedAesKey), nil
 }
 
-func RsaDecrypt(body string) ([]byte, error) {
-	privateKey, err := os.ReadFile("private.pem")
+// RsaDecrypt decrypts a legacy payload, a body RSA-PKCS#1 v1.5 encrypted as a
+// whole, with the key named kid. Payloads from clients that send no kid are
+// tried against every accepted key.
+func (k *KeyManager) RsaDecrypt(kid string, body string) ([]byte, error) {
+	keys, err := k.privateKeys(kid)
 	if err != nil {
-		return nil, fmt.Errorf("could not read private key file: %v", err)
+		return nil, err
 	}
 
 	cipherText, err := base64.StdEncoding.DecodeString(body)
@@ -85,70 +74,26 @@ func RsaDecrypt(body string) ([]byte, error) {
 		return nil, fmt.Errorf("base64 decode error: %v", err)
 	}
 
-	block, _ := pem.Decode(privateKey)
-	if block == nil {
-		return nil, errors.New("failed to parse private key PEM")
-	}
-
-	priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
-	if err != nil {
-		return nil, fmt.Errorf("private key parsing error: %v", err)
-	}
-
-	decryptedData, err := rsa.DecryptPKCS1v15(rand.Reader, priv, cipherText)
-	if err != nil {
-		return nil, fmt.Errorf("decryption error: %v", err)
-	}
-
-	return decryptedData, nil
-}
-
-func (a *application) GetAllKeysHandler(w http.ResponseWriter, r *http.Request) {
-	// Load public key from file
-	publicKey, err := os.ReadFile("public.pem")
-	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err)
-		return
-	}
-	privateKey, err := os.ReadFile("private.pem")
-	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err)
-		return
-	}
-
-	keys := Key{
-		PublicKey:  string(publicKey),
-		PrivateKey: string(privateKey),
+	for _, priv := range keys {
+		if decryptedData, err := rsa.DecryptPKCS1v15(rand.Reader, priv, cipherText); err == nil {
+			return decryptedData, nil
+		}
 	}
 
-	// Write public key as JSON response
-	utils.WriteJSON(w, http.StatusAccepted, keys)
+	return nil, errors.New("decryption error")
 }
 
-func GenerateRSAKeys() error {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		return err
-	}
+// pruneNonces periodically deletes the request nonces that are too old to
+// matter, as the payloads that carried them are refused as stale anyway.
+func (a *application) pruneNonces() {
+	ticker := time.NewTicker(utils.PayloadMaxAge())
+	defer ticker.Stop()
 
-	privateKeyFile, err := os.Create("private.pem")
-	if err != nil {
-		return err
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if _, err := a.store.Nonces.PruneNonces(ctx); err != nil {
+			a.logger.Errorf("Could not prune request nonces: %v", err)
+		}
+		cancel()
 	}
-	defer privateKeyFile.Close()
-
-	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
-	privateKeyFile.Write(privateKeyPEM)
-
-	publicKey := &privateKey.PublicKey
-	publicKeyFile, err := os.Create("public.pem")
-	if err != nil {
-		return err
-	}
-	defer publicKeyFile.Close()
-
-	publicKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PUBLIC KEY", Bytes: x509.MarshalPKCS1PublicKey(publicKey)})
-	publicKeyFile.Write(publicKeyPEM)
-
-	return nil
 }
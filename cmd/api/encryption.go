@@ -0,0 +1,118 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+)
+
+// PayloadEncryptionHeader negotiates how a request and its response are sent:
+// "envelope" (the default) or "none". Plaintext is only accepted when
+// ALLOW_PLAINTEXT_PAYLOADS is true, which is meant for development.
+const PayloadEncryptionHeader = "X-Payload-Encryption"
+
+const (
+	payloadEnvelope  = "envelope"
+	payloadPlaintext = "none"
+)
+
+// bufferedResponse holds on to what a handler writes so it can be encrypted
+// as a whole once the handler is done.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	br.status = status
+}
+
+func (br *bufferedResponse) Write(b []byte) (int, error) {
+	return br.body.Write(b)
+}
+
+func plaintextAllowed() bool {
+	return os.Getenv("ALLOW_PLAINTEXT_PAYLOADS") == "true"
+}
+
+// EncryptionMiddleware decrypts request bodies and encrypts responses for the
+// routes it is mounted on, so handlers only read and write plain JSON. It goes
+// after IdempotencyMiddleware: a retry is answered with the stored response
+// before its nonce would be refused as a replay, and payloads it refuses free
+// the idempotency key for the client to send them again.
+func (a *application) EncryptionMiddleware(next http.Handler) http.Handler {
+	return a.encryption(next, true)
+}
+
+// MoneyEncryptionMiddleware is EncryptionMiddleware for routes that move
+// money. It refuses legacy payloads, which could be captured and replayed.
+func (a *application) MoneyEncryptionMiddleware(next http.Handler) http.Handler {
+	return a.encryption(next, false)
+}
+
+func (a *application) encryption(next http.Handler, allowLegacy bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get(PayloadEncryptionHeader) {
+		case payloadPlaintext:
+			if !plaintextAllowed() {
+				releaseIdempotencyKey(r)
+				utils.WriteError(w, http.StatusBadRequest, &types.CodedError{Code: types.ErrorEncryptionRequired, Message: "Payloads must be encrypted"})
+				return
+			}
+
+			w.Header().Set(PayloadEncryptionHeader, payloadPlaintext)
+			next.ServeHTTP(w, r)
+			return
+		case "", payloadEnvelope:
+		default:
+			releaseIdempotencyKey(r)
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Unsupported %s: %s", PayloadEncryptionHeader, r.Header.Get(PayloadEncryptionHeader)))
+			return
+		}
+
+		// Check there is a key to encrypt the response to before the handler
+		// does any work.
+		if _, err := utils.ClientPublicKey(r); err != nil {
+			releaseIdempotencyKey(r)
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if r.Body != nil && r.ContentLength != 0 {
+			body, err := io.ReadAll(r.Body)
+			if err != nil {
+				releaseIdempotencyKey(r)
+				utils.WriteError(w, http.StatusBadRequest, err)
+				return
+			}
+
+			if len(body) > 0 {
+				r.Body = io.NopCloser(bytes.NewReader(body))
+				decrypted, err := utils.DecryptAndParseJson(r, a.keys, a.store.Nonces, allowLegacy)
+				if err != nil {
+					a.logger.Infof("Could not decrypt payload: %v", err)
+					releaseIdempotencyKey(r)
+					utils.WriteError(w, http.StatusBadRequest, err)
+					return
+				}
+				body = decrypted
+			}
+
+			r.Body = io.NopCloser(bytes.NewReader(body))
+			r.ContentLength = int64(len(body))
+		}
+
+		response := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(response, r)
+
+		w.Header().Del("Content-Type")
+		w.Header().Set(PayloadEncryptionHeader, payloadEnvelope)
+		utils.EncryptAndWriteJson(w, r, response.status, bytes.TrimSpace(response.body.Bytes()), a.keys)
+	})
+}
@@ -0,0 +1,196 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/brownei/chifunds-api/utils"
+)
+
+// responseRecorder keeps a copy of everything a handler writes so the
+// response can be stored and replayed later.
+type responseRecorder struct {
+	http.ResponseWriter
+	status  int
+	headers map[string]string
+	body    bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	rr.status = status
+	rr.keepHeaders()
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	rr.keepHeaders()
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// keepHeaders copies the headers a replay needs once they are final.
+func (rr *responseRecorder) keepHeaders() {
+	if rr.headers != nil {
+		return
+	}
+
+	rr.headers = map[string]string{}
+	for _, name := range replayedHeaders {
+		if value := rr.Header().Get(name); value != "" {
+			rr.headers[name] = value
+		}
+	}
+}
+
+// replayedHeaders are the response headers stored with an idempotent
+// response. Without them a replayed envelope could not be told from JSON.
+// Headers set by the middleware in front, like CORS, are left out: they are
+// set again for the retry itself.
+var replayedHeaders = []string{"Content-Type", PayloadEncryptionHeader, "Retry-After"}
+
+// idempotencyRelease is put in the request context by IdempotencyMiddleware.
+// Setting it keeps the response from being stored, for refusals the client
+// fixes by sending the request again changed: a payload that could not be
+// decrypted or was stale, or a missing two-factor code. Stored, such a refusal
+// would answer every retry, and the changed request would clash with the hash
+// kept for the key.
+type idempotencyRelease struct {
+	release bool
+}
+
+// releaseIdempotencyKey frees the request's idempotency key once the handler
+// returns, so it can be used again.
+func releaseIdempotencyKey(r *http.Request) {
+	if release, ok := r.Context().Value("idempotency").(*idempotencyRelease); ok {
+		release.release = true
+	}
+}
+
+// IdempotencyMiddleware honours the Idempotency-Key header. The first request
+// with a key runs normally and its response is stored; a retry with the same
+// key and payload gets the stored response back instead of running again.
+// Encrypted requests are compared by the payload inside the envelope, so a
+// retry may be encrypted again; the replayed response is still encrypted to
+// the client key of the first request.
+func (a *application) IdempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if len(key) > 255 {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Idempotency key is too long"))
+			return
+		}
+
+		ctx := r.Context()
+		email := ctx.Value("user").(string)
+		existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+		if existingUser == nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		hash := sha256.New()
+		fmt.Fprintf(hash, "%s %s\n", r.Method, r.URL.Path)
+		hash.Write(a.idempotentPayload(r, body))
+		requestHash := hex.EncodeToString(hash.Sum(nil))
+
+		record, err := a.store.Idempotency.ReserveIdempotencyKey(ctx, existingUser.ID, key, requestHash)
+		if err != nil {
+			a.logger.Errorf("Idempotency key reservation failed: %v", err)
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		if record != nil {
+			if record.RequestHash != requestHash {
+				utils.WriteError(w, http.StatusUnprocessableEntity, fmt.Errorf("Idempotency key was already used for a different request"))
+				return
+			}
+
+			if !record.Completed {
+				utils.WriteError(w, http.StatusConflict, fmt.Errorf("A request with this idempotency key is still being processed"))
+				return
+			}
+
+			for name, value := range record.Headers {
+				w.Header().Set(name, value)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(record.StatusCode)
+			w.Write(record.Response)
+			return
+		}
+
+		// The outcome is saved even if the client has already gone away,
+		// that is exactly the case a retry will come back for.
+		saveCtx := context.WithoutCancel(ctx)
+		recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		defer func() {
+			if p := recover(); p != nil {
+				a.store.Idempotency.ReleaseIdempotencyKey(saveCtx, existingUser.ID, key)
+				panic(p)
+			}
+		}()
+
+		release := &idempotencyRelease{}
+		next.ServeHTTP(recorder, r.WithContext(context.WithValue(ctx, "idempotency", release)))
+
+		if recorder.status >= http.StatusInternalServerError || release.release {
+			err = a.store.Idempotency.ReleaseIdempotencyKey(saveCtx, existingUser.ID, key)
+		} else {
+			recorder.keepHeaders()
+			err = a.store.Idempotency.CompleteIdempotencyKey(saveCtx, existingUser.ID, key, recorder.status, recorder.headers, recorder.body.Bytes())
+		}
+
+		if err != nil {
+			a.logger.Errorf("Could not save idempotency key %s: %v", key, err)
+		}
+	})
+}
+
+// idempotentPayload is the part of the request body a retry has to repeat.
+// Every encryption of a payload differs, so for an envelope it is the payload
+// inside, which is opened without claiming its nonce: the encryption
+// middleware still checks it when the request runs. The JSON is reformatted
+// so that spacing and field order do not count.
+func (a *application) idempotentPayload(r *http.Request, body []byte) []byte {
+	payload := body
+	if r.Header.Get(PayloadEncryptionHeader) != payloadPlaintext {
+		if opened, err := utils.PeekPayload(body, a.keys); err == nil {
+			payload = opened
+		}
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(payload))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return payload
+	}
+
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return payload
+	}
+
+	return canonical
+}
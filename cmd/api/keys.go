@@ -0,0 +1,310 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brownei/chifunds-api/store"
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"go.uber.org/zap"
+)
+
+const (
+	// legacyKeyFile is where the key pair lived before keys were kept in the
+	// database. Its private key used to be served to clients, so it is taken
+	// as compromised: it is imported already retiring, only so clients holding
+	// its public key keep working through the overlap.
+	legacyKeyFile = "private.pem"
+	// keyRefreshInterval is how often every instance reloads the keys and
+	// checks whether the current one is due for rotation.
+	keyRefreshInterval = 10 * time.Minute
+)
+
+// KeyManager holds the RSA keys clients encrypt payloads to. The keys live in
+// the database so every instance decrypts with the same ones, and are rotated
+// on a schedule with an overlap during which the replaced key still works.
+type KeyManager struct {
+	store       store.Store
+	logger      *zap.SugaredLogger
+	rotateAfter time.Duration
+	overlap     time.Duration
+
+	mu        sync.RWMutex
+	current   *types.EncryptionKey
+	keys      map[string]*rsa.PrivateKey
+	order     []string
+	published types.JSONWebKeySet
+}
+
+// NewKeyManager reads the rotation schedule from KEY_ROTATION_DAYS and
+// KEY_OVERLAP_DAYS. The overlap should cover how long clients cache the
+// published keys.
+func NewKeyManager(store store.Store, logger *zap.SugaredLogger) *KeyManager {
+	return &KeyManager{
+		store:       store,
+		logger:      logger,
+		rotateAfter: envDays("KEY_ROTATION_DAYS", 30),
+		overlap:     envDays("KEY_OVERLAP_DAYS", 7),
+		keys:        make(map[string]*rsa.PrivateKey),
+	}
+}
+
+func envDays(key string, fallback int) time.Duration {
+	days, err := strconv.Atoi(os.Getenv(key))
+	if err != nil || days <= 0 {
+		days = fallback
+	}
+
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Load reads the keys from the database. On the first boot there is no
+// current key, so a new one is made, and the legacy key file imported next to
+// it as a retiring key when there is one.
+func (k *KeyManager) Load(ctx context.Context) error {
+	keys, err := k.store.Keys.GetEncryptionKeys(ctx)
+	if err != nil {
+		return err
+	}
+
+	if !slices.ContainsFunc(keys, func(key types.EncryptionKey) bool { return key.RetiresAt == nil }) {
+		if len(keys) == 0 {
+			legacy, err := legacyKey()
+			if err != nil {
+				return err
+			}
+			if legacy != nil {
+				k.logger.Warnf("Importing %s as encryption key %s, retiring in %s; delete the file once it is imported", legacyKeyFile, legacy.Kid, k.overlap)
+				if err := k.store.Keys.ImportRetiringKey(ctx, *legacy, k.overlap); err != nil {
+					return err
+				}
+			}
+		}
+
+		key, err := newEncryptionKey()
+		if err != nil {
+			return err
+		}
+
+		if _, err := k.store.Keys.RotateEncryptionKey(ctx, *key, k.rotateAfter, k.overlap); err != nil {
+			return err
+		}
+
+		if keys, err = k.store.Keys.GetEncryptionKeys(ctx); err != nil {
+			return err
+		}
+	}
+
+	parsed := make(map[string]*rsa.PrivateKey, len(keys))
+	order := make([]string, 0, len(keys))
+	published := types.JSONWebKeySet{Keys: []types.JSONWebKey{}}
+	var current *types.EncryptionKey
+	for i, key := range keys {
+		private, err := parsePrivateKey(key.PrivateKey)
+		if err != nil {
+			return fmt.Errorf("encryption key %s: %v", key.Kid, err)
+		}
+
+		parsed[key.Kid] = private
+		order = append(order, key.Kid)
+		published.Keys = append(published.Keys, jsonWebKey(key.Kid, &private.PublicKey))
+		if current == nil && key.RetiresAt == nil {
+			current = &keys[i]
+		}
+	}
+
+	if current == nil {
+		return errors.New("there is no current encryption key")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.current = current
+	k.keys = parsed
+	k.order = order
+	k.published = published
+
+	return nil
+}
+
+// Rotate replaces the current key when it is older than the rotation period.
+// Instances race for it under an advisory lock, the losers pick up the
+// winner's key when they reload.
+func (k *KeyManager) Rotate(ctx context.Context) error {
+	k.mu.RLock()
+	due := k.current == nil || time.Since(k.current.CreatedAt) >= k.rotateAfter
+	k.mu.RUnlock()
+
+	if !due {
+		return nil
+	}
+
+	key, err := newEncryptionKey()
+	if err != nil {
+		return err
+	}
+
+	rotated, err := k.store.Keys.RotateEncryptionKey(ctx, *key, k.rotateAfter, k.overlap)
+	if err != nil {
+		return err
+	}
+	if rotated {
+		k.logger.Infof("Rotated encryption key, the current key is now %s", key.Kid)
+	}
+
+	return k.Load(ctx)
+}
+
+// refreshKeys periodically reloads the keys so a rotation done by another
+// instance is picked up, and rotates when the current key is due.
+func (k *KeyManager) refreshKeys() {
+	ticker := time.NewTicker(keyRefreshInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		if err := k.Load(ctx); err != nil {
+			k.logger.Errorf("Could not reload encryption keys: %v", err)
+		} else if err := k.Rotate(ctx); err != nil {
+			k.logger.Errorf("Could not rotate encryption key: %v", err)
+		}
+		cancel()
+	}
+}
+
+// JWKS returns the public keys clients may encrypt to, the current key first.
+func (k *KeyManager) JWKS() types.JSONWebKeySet {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.published
+}
+
+// privateKeys returns the key named kid, or every accepted key newest first
+// when kid is empty.
+func (k *KeyManager) privateKeys(kid string) ([]*rsa.PrivateKey, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if kid == "" {
+		keys := make([]*rsa.PrivateKey, 0, len(k.order))
+		for _, kid := range k.order {
+			keys = append(keys, k.keys[kid])
+		}
+		return keys, nil
+	}
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, &types.CodedError{Code: types.ErrorUnknownKey, Message: "The payload was encrypted to a key that is no longer accepted, fetch the current keys and try again"}
+	}
+
+	return []*rsa.PrivateKey{key}, nil
+}
+
+// Open decrypts a request envelope with the key named by its kid.
+func (k *KeyManager) Open(envelope types.Envelope) ([]byte, error) {
+	keys, err := k.privateKeys(envelope.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		if data, err := utils.OpenEnvelope(key, envelope); err == nil {
+			return data, nil
+		} else if len(keys) == 1 {
+			return nil, err
+		}
+	}
+
+	return nil, &types.CodedError{Code: types.ErrorInvalidPayload, Message: "Invalid encrypted payload"}
+}
+
+func (k *KeyManager) currentKey() *rsa.PrivateKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.keys[k.current.Kid]
+}
+
+// GetJWKS publishes the public keys in JWKS format. Private keys never leave
+// the server.
+func (a *application) GetJWKS(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	utils.WriteJSON(w, http.StatusOK, a.keys.JWKS())
+}
+
+func newEncryptionKey() (*types.EncryptionKey, error) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	return encryptionKey(private), nil
+}
+
+// legacyKey reads the key file written by earlier versions, if there is one.
+func legacyKey() (*types.EncryptionKey, error) {
+	data, err := os.ReadFile(legacyKeyFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	private, err := parsePrivateKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", legacyKeyFile, err)
+	}
+
+	return encryptionKey(private), nil
+}
+
+func encryptionKey(private *rsa.PrivateKey) *types.EncryptionKey {
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(private)})
+
+	return &types.EncryptionKey{
+		Kid:        utils.KeyThumbprint(&private.PublicKey),
+		PrivateKey: string(encoded),
+	}
+}
+
+func parsePrivateKey(encoded string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return nil, errors.New("failed to parse private key PEM")
+	}
+
+	private, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("private key parsing error: %v", err)
+	}
+
+	return private, nil
+}
+
+func jsonWebKey(kid string, public *rsa.PublicKey) types.JSONWebKey {
+	return types.JSONWebKey{
+		Kty: "RSA",
+		Kid: kid,
+		Use: "enc",
+		Alg: "RSA-OAEP-256",
+		N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+	}
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/brownei/chifunds-api/db"
+	"github.com/brownei/chifunds-api/store"
+	"github.com/brownei/chifunds-api/types"
+	"github.com/lib/pq"
+)
+
+// eventNotification is an event as it is sent over Postgres, which unlike
+// the copy written to clients carries the user it belongs to.
+type eventNotification struct {
+	Id        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	UserId    int64           `json:"user_id"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+// ListenForEvents relays the events published by every API instance into
+// the local hub until ctx is done, then closes the returned channel. The
+// listener reconnects on its own; notifications sent while it was
+// disconnected are lost, and clients only see them on their next balance
+// snapshot.
+func (a *application) ListenForEvents(ctx context.Context) (<-chan struct{}, error) {
+	listener := pq.NewListener(db.ConnectionString(), 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		switch event {
+		case pq.ListenerEventDisconnected:
+			a.logger.Errorf("Event listener disconnected: %v", err)
+		case pq.ListenerEventReconnected:
+			a.logger.Info("Event listener reconnected")
+		case pq.ListenerEventConnectionAttemptFailed:
+			a.logger.Errorf("Event listener could not connect: %v", err)
+		}
+	})
+
+	if err := listener.Listen(store.EventsChannel); err != nil {
+		listener.Close()
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer listener.Close()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case notification := <-listener.Notify:
+				// A nil notification only signals that the connection was
+				// re-established.
+				if notification == nil {
+					continue
+				}
+
+				var event eventNotification
+				if err := json.Unmarshal([]byte(notification.Extra), &event); err != nil {
+					a.logger.Errorf("Invalid event notification: %v", err)
+					continue
+				}
+
+				a.hub.Deliver(types.Event{
+					Id:        event.Id,
+					Type:      event.Type,
+					UserId:    event.UserId,
+					Data:      event.Data,
+					CreatedAt: event.CreatedAt.UTC(),
+				})
+			case <-time.After(90 * time.Second):
+				// Check the connection is still alive when it has been quiet.
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return done, nil
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"github.com/go-chi/chi/v5"
+	"github.com/go-playground/validator/v10"
+)
+
+func (a *application) AllLoanRoutes(r chi.Router) {
+	r.Use(a.AuthMiddleware)
+	r.With(a.RequireVerifiedEmail, a.IdempotencyMiddleware, a.MoneyEncryptionMiddleware).Post("/{id}/repay", a.RepayLoan)
+	r.Group(func(r chi.Router) {
+		r.Use(a.EncryptionMiddleware)
+		r.Get("/", a.GetLoans)
+		r.Get("/eligibility", a.GetLoanEligibility)
+		r.Get("/{id}", a.GetLoan)
+	})
+}
+
+func (a *application) GetLoans(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	loans, err := a.store.Loans.GetLoans(ctx, existingUser.ID)
+	if err != nil {
+		a.logger.Info(err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, loans)
+}
+
+func (a *application) GetLoanEligibility(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	eligibility, err := a.store.Loans.GetEligibility(ctx, existingUser.ID)
+	if err != nil {
+		a.logger.Info(err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, eligibility)
+}
+
+func (a *application) GetLoan(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	loanId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid loan id"))
+		return
+	}
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	loan, err := a.store.Loans.GetLoan(ctx, existingUser.ID, loanId)
+	if err != nil {
+		utils.WriteError(w, http.StatusNotFound, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, loan)
+}
+
+func (a *application) RepayLoan(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	loanId, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid loan id"))
+		return
+	}
+
+	var payload types.RepayLoanDto
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	loan, err := a.store.Loans.RepayLoan(ctx, a.logger, existingUser.ID, loanId, payload.Amount)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	a.pushBalance(ctx, existingUser.ID)
+
+	utils.WriteJSON(w, http.StatusAccepted, loan)
+}
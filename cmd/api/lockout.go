@@ -0,0 +1,105 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/brownei/chifunds-api/mailer"
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+)
+
+const (
+	purposeUnlockAccount = "unlock_account"
+	// unlockLinkTTL is how long the emailed unlock link works. Locks end on
+	// their own before then unless the policy makes them longer.
+	unlockLinkTTL = 24 * time.Hour
+)
+
+// clientIP is the address the request came from. middleware.RealIP has
+// already replaced RemoteAddr with the address from the proxy headers.
+func clientIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+
+	return r.RemoteAddr
+}
+
+// writeLoginThrottle answers a request that has to wait before trying again.
+func writeLoginThrottle(w http.ResponseWriter, throttle *types.LoginThrottle) {
+	w.Header().Set("Retry-After", strconv.Itoa(throttle.RetryAfter))
+	if throttle.Locked {
+		utils.WriteError(w, http.StatusTooManyRequests, &types.CodedError{Code: types.ErrorAccountLocked, Message: "This account is locked after too many failed sign ins, check your email to unlock it"})
+		return
+	}
+	utils.WriteError(w, http.StatusTooManyRequests, &types.CodedError{Code: types.ErrorTooManyAttempts, Message: fmt.Sprintf("Too many failed sign ins, try again in %d seconds", throttle.RetryAfter)})
+}
+
+// recordLoginFailure counts a failed sign in and emails the user an unlock
+// link when it locked their account. Failures to record are only logged so
+// they never change the answer the client gets.
+func (a *application) recordLoginFailure(ctx context.Context, attempt types.LoginAttempt, user *types.User) {
+	locked, err := a.store.LoginAttempts.RecordLoginFailure(ctx, attempt)
+	if err != nil {
+		a.logger.Errorf("Could not record failed sign in: %v", err)
+		return
+	}
+
+	if !locked || user == nil {
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 30*time.Second)
+		defer cancel()
+
+		if err := a.sendUnlockEmail(ctx, user, attempt); err != nil {
+			a.logger.Errorf("Could not send unlock email to user %d: %v", user.ID, err)
+		}
+	}()
+}
+
+func (a *application) sendUnlockEmail(ctx context.Context, user *types.User, attempt types.LoginAttempt) error {
+	token, err := utils.PurposeToken(user.Email, purposeUnlockAccount, unlockLinkTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/v1/auth/unlock?token=%s", appURL(), url.QueryEscape(token))
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Your ChiFunds account has been locked",
+		Body:    fmt.Sprintf("Hi %s,\n\nWe locked your ChiFunds account after too many failed sign ins, the last one from %s. If this was you, unlock your account here:\n\n%s\n\nIf it was not, reset your password once you are back in.\n", user.FirstName, attempt.IP, link),
+	})
+}
+
+// UnlockAccount lifts a lockout from the emailed link. QueryTokenMiddleware
+// has already taken the token off the URL so it is not logged.
+func (a *application) UnlockAccount(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	token, _ := ctx.Value("queryToken").(string)
+	if token == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("No token"))
+		return
+	}
+
+	email, err := utils.VerifyPurposeToken(token, purposeUnlockAccount)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := a.store.LoginAttempts.UnlockAccount(ctx, email); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Account unlocked, you can sign in again")
+}
@@ -5,15 +5,16 @@ import (
 	"fmt"
 	"net/http"
 	"os"
+	"slices"
 	"strings"
 
+	"github.com/brownei/chifunds-api/types"
 	"github.com/brownei/chifunds-api/utils"
 )
 
 func (a *application) AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
-		a.logger.Info(authHeader)
 		if authHeader == "" {
 			a.logger.Errorf("Unauthorized permission: %s", fmt.Errorf("No token"))
 			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("No token"))
@@ -28,7 +29,7 @@ func (a *application) AuthMiddleware(next http.Handler) http.Handler {
 		}
 
 		token := parts[1]
-		userEmail, err := utils.VerifyToken(token)
+		claims, err := utils.VerifyToken(token)
 		if err != nil {
 			//a.logger.Errorf("Unauthorized permission: %s", err.Error())
 			utils.WriteError(w, http.StatusUnauthorized, err)
@@ -37,38 +38,115 @@ func (a *application) AuthMiddleware(next http.Handler) http.Handler {
 
 		ctx := r.Context()
 
-		ctx = context.WithValue(ctx, "user", userEmail)
+		// Access tokens stay valid until they expire, so a revoked session is
+		// only caught here.
+		active, err := a.store.Auth.SessionActive(ctx, claims.SessionId)
+		if err != nil {
+			utils.WriteError(w, http.StatusInternalServerError, err)
+			return
+		} else if !active {
+			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("Session has been revoked, sign in again"))
+			return
+		}
+
+		ctx = context.WithValue(ctx, "user", claims.Email)
+		ctx = context.WithValue(ctx, "session", claims.SessionId)
+		ctx = context.WithValue(ctx, "role", claims.Role)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func (a *application) PublicKeyMiddleware(next http.Handler) http.Handler {
+// QueryTokenMiddleware takes an access token passed as the "token" query
+// parameter off the URL before the request is logged, so it never ends up in
+// access logs. The token is kept in the context for StreamAuthMiddleware.
+func (a *application) QueryTokenMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		secretToken := os.Getenv("SECRET_KEY")
-		authHeader := r.Header.Get("Authorization")
-		a.logger.Info(authHeader)
-		if authHeader == "" {
-			a.logger.Errorf("Unauthorized permission: %s", fmt.Errorf("No token"))
-			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("No token"))
+		query := r.URL.Query()
+		token := query.Get("token")
+		if token == "" {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			a.logger.Errorf("Unauthorized permission: %s", fmt.Errorf("No Bearer token"))
-			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("Not the Bearer Token"))
+		query.Del("token")
+		r.URL.RawQuery = query.Encode()
+		r.RequestURI = r.URL.RequestURI()
+
+		ctx := context.WithValue(r.Context(), "queryToken", token)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// StreamAuthMiddleware is AuthMiddleware for streaming clients. EventSource
+// cannot set headers, so the token may also come from the "token" query
+// parameter or the chifunds_token cookie.
+func (a *application) StreamAuthMiddleware(next http.Handler) http.Handler {
+	auth := a.AuthMiddleware(next)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			token, _ := r.Context().Value("queryToken").(string)
+			if cookie, err := r.Cookie("chifunds_token"); token == "" && err == nil {
+				token = cookie.Value
+			}
+
+			if token != "" {
+				r.Header.Set("Authorization", "Bearer "+token)
+			}
+		}
+
+		auth.ServeHTTP(w, r)
+	})
+}
+
+// RequireVerifiedEmail keeps users who have not verified their email away from
+// routes that move money. It must run after AuthMiddleware.
+func (a *application) RequireVerifiedEmail(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		email, _ := r.Context().Value("user").(string)
+
+		existingUser, _ := a.store.Users.GetUsersByEmail(r.Context(), email, false)
+		if existingUser == nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
 			return
 		}
 
-		token := parts[1]
-		a.logger.Info(secretToken, token)
-		if token != secretToken {
-			//a.logger.Errorf("Unauthorized permission: %s", err.Error())
+		if !existingUser.EmailVerified {
+			utils.WriteError(w, http.StatusForbidden, &types.CodedError{Code: types.ErrorEmailNotVerified, Message: "Verify your email to use this feature"})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireRole only lets users with one of the roles through. It must run
+// after AuthMiddleware.
+func (a *application) RequireRole(roles ...string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			role, _ := r.Context().Value("role").(string)
+			if !slices.Contains(roles, role) {
+				utils.WriteError(w, http.StatusForbidden, fmt.Errorf("Unauthorized to view call this method"))
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// MerchantMiddleware lets merchants of the simulated card network in with the
+// MERCHANT_API_KEY as a Bearer token.
+func (a *application) MerchantMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		merchantKey := os.Getenv("MERCHANT_API_KEY")
+		parts := strings.Split(r.Header.Get("Authorization"), " ")
+		if merchantKey == "" || len(parts) != 2 || parts[0] != "Bearer" || parts[1] != merchantKey {
 			utils.WriteError(w, http.StatusUnauthorized, fmt.Errorf("Unauthorized to view call this method"))
 			return
 		}
 
-		ctx := r.Context()
-		next.ServeHTTP(w, r.WithContext(ctx))
+		next.ServeHTTP(w, r)
 	})
 }
@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/brownei/chifunds-api/mailer"
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"github.com/go-playground/validator/v10"
+)
+
+// frontendURL is the address of the web app, which hosts the page users
+// choose their new password on.
+func frontendURL() string {
+	if address := os.Getenv("FRONTEND_URL"); address != "" {
+		return address
+	}
+
+	return "https://chifunds.vercel.app"
+}
+
+// ForgotPassword emails a reset link to the address if it belongs to a user.
+// The answer is the same, and sent just as fast, whether or not it does, so
+// the endpoint cannot be used to find out who has an account.
+func (a *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload types.ForgotPasswordDto
+
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), 30*time.Second)
+		defer cancel()
+
+		if err := a.sendPasswordReset(ctx, payload.Email); err != nil {
+			a.logger.Errorf("Could not send password reset: %v", err)
+		}
+	}()
+
+	utils.WriteJSON(w, http.StatusAccepted, "If an account exists for this email, a reset link has been sent to it")
+}
+
+func (a *application) sendPasswordReset(ctx context.Context, email string) error {
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		return nil
+	}
+
+	token, err := a.store.Auth.CreatePasswordReset(ctx, existingUser.ID)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/reset-password?token=%s", frontendURL(), url.QueryEscape(token))
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      existingUser.Email,
+		Subject: "Reset your ChiFunds password",
+		Body:    fmt.Sprintf("Hi %s,\n\nSomeone asked to reset the password of your ChiFunds account. Choose a new one here:\n\n%s\n\nThe link expires in an hour and works once. If this was not you, you can ignore this email.\n", existingUser.FirstName, link),
+	})
+}
+
+// ResetPassword sets a new password from a reset link. Every session of the
+// user is signed out, so they sign in again with the new password.
+func (a *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var payload types.ResetPasswordDto
+
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return
+	}
+
+	if err := a.store.Auth.ResetPassword(ctx, payload.Token, payload.Password); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Password updated, sign in with your new password")
+}
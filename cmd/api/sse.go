@@ -1,65 +1,264 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+)
+
+const (
+	// clientBuffer is how many events a slow client may fall behind before it
+	// is dropped.
+	clientBuffer = 16
+	// eventLogSize and eventLogTTL bound the per-user log replayed to clients
+	// that reconnect with a Last-Event-ID.
+	eventLogSize = 100
+	eventLogTTL  = 15 * time.Minute
+	// heartbeatInterval keeps proxies from closing idle streams.
+	heartbeatInterval = 15 * time.Second
 )
 
 // Client represents a connection to be notified
 type Client struct {
-	channel chan string
+	channel chan types.Event
+}
+
+// Hub keeps the open streams of every user so events only reach the
+// connections of the user they belong to, along with a short log of each
+// user's recent events for replay.
+type Hub struct {
+	mu      sync.Mutex
+	closed  bool
+	clients map[int64]map[*Client]struct{}
+	logs    map[int64][]types.Event
+}
+
+func NewHub() *Hub {
+	return &Hub{
+		clients: make(map[int64]map[*Client]struct{}),
+		logs:    make(map[int64][]types.Event),
+	}
+}
+
+// Register opens a client for the user. When lastEventId is set, the logged
+// events after it are returned so the caller can replay them before the
+// client's live events.
+func (h *Hub) Register(userId int64, lastEventId uint64) (*Client, []types.Event) {
+	client := &Client{channel: make(chan types.Event, clientBuffer)}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// Once the hub is closed clients get a closed channel and end right away.
+	if h.closed {
+		close(client.channel)
+		return client, nil
+	}
+
+	if h.clients[userId] == nil {
+		h.clients[userId] = make(map[*Client]struct{})
+	}
+	h.clients[userId][client] = struct{}{}
+
+	var missed []types.Event
+	if lastEventId != 0 {
+		for _, event := range h.logs[userId] {
+			if event.Id > lastEventId {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	return client, missed
+}
+
+// Unregister removes the client and closes its channel. It is safe to call
+// for a client that has already been dropped.
+func (h *Hub) Unregister(userId int64, client *Client) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(userId, client)
+}
+
+func (h *Hub) remove(userId int64, client *Client) {
+	if _, ok := h.clients[userId][client]; !ok {
+		return
+	}
+
+	delete(h.clients[userId], client)
+	if len(h.clients[userId]) == 0 {
+		delete(h.clients, userId)
+	}
+	close(client.channel)
+}
+
+// Deliver appends the event to its user's log and sends it to their clients.
+// Clients that are too far behind to take it are dropped rather than blocking
+// the listener.
+func (h *Hub) Deliver(event types.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	log := append(h.logs[event.UserId], event)
+	for len(log) > 0 && (len(log) > eventLogSize || time.Since(log[0].CreatedAt) > eventLogTTL) {
+		log = log[1:]
+	}
+	h.logs[event.UserId] = log
+
+	for client := range h.clients[event.UserId] {
+		select {
+		case client.channel <- event:
+		default:
+			h.remove(event.UserId, client)
+		}
+	}
 }
 
-// global slice to manage connected clients
-var clients = make([]*Client, 0)
+// Close ends every open stream. It runs when the server shuts down, as the
+// server does not wait for streams or hijacked WebSocket connections itself.
+func (h *Hub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for userId, clients := range h.clients {
+		for client := range clients {
+			h.remove(userId, client)
+		}
+	}
+}
+
+// Prune forgets the logs of users whose latest event is too old to replay.
+func (h *Hub) Prune() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for userId, log := range h.logs {
+		if len(log) == 0 || time.Since(log[len(log)-1].CreatedAt) > eventLogTTL {
+			delete(h.logs, userId)
+		}
+	}
+}
+
+// Handler to send account events
+func (a *application) SseRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("Streaming is not supported"))
+		return
+	}
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	balance, err := a.store.Users.GetUserBalance(ctx, existingUser.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	client, missed := a.hub.Register(existingUser.ID, lastEventId(r))
+	defer a.hub.Unregister(existingUser.ID, client)
 
-// Handler to send balance updates
-func SseRoute(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "text/event-stream")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
-	// Create new client
-	client := &Client{channel: make(chan string)}
-	clients = append(clients, client)
+	// Start every stream with the current balance. It carries no id so it
+	// does not move the client's Last-Event-ID.
+	snapshot, _ := json.Marshal(balance)
+	writeEvent(w, types.Event{Type: types.EventBalanceUpdated, Data: snapshot, CreatedAt: time.Now().UTC()})
+	for _, event := range missed {
+		writeEvent(w, event)
+	}
+	flusher.Flush()
 
-	// Close connection on client disconnect
-	defer func() {
-		close(client.channel)
-		removeClient(client)
-	}()
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
 
 	// Listen to the client channel and send data as SSE events
 	for {
 		select {
-		case msg := <-client.channel:
-			fmt.Fprintf(w, "data: %s\n\n", msg)
-			w.(http.Flusher).Flush()
-		case <-r.Context().Done():
+		case event, ok := <-client.channel:
+			if !ok {
+				return
+			}
+			writeEvent(w, event)
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+			flusher.Flush()
+		case <-ctx.Done():
 			return
 		}
 	}
 }
 
-// Function to remove client from the slice
-func removeClient(client *Client) {
-	for i, c := range clients {
-		if c == client {
-			clients = append(clients[:i], clients[i+1:]...)
-			break
-		}
+// lastEventId is the id of the last event the client saw before reconnecting.
+// Browsers send the header on automatic reconnects, the query parameter
+// covers clients that reconnect by hand.
+func lastEventId(r *http.Request) uint64 {
+	id := r.Header.Get("Last-Event-ID")
+	if id == "" {
+		id = r.URL.Query().Get("lastEventId")
 	}
+
+	since, _ := strconv.ParseUint(id, 10, 64)
+	return since
 }
 
-// Broadcast balance update to all connected clients
-func broadcastBalanceUpdate(balance string) {
-	for _, client := range clients {
-		select {
-		case client.channel <- balance:
-		default:
-			close(client.channel)
-			removeClient(client)
-		}
+func writeEvent(w http.ResponseWriter, event types.Event) {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	if event.Id != 0 {
+		fmt.Fprintf(w, "id: %d\n", event.Id)
+	}
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+}
+
+// publish sends an event to the user's open streams on every instance. It is
+// called once the change the event describes has been committed.
+func (a *application) publish(ctx context.Context, userId int64, eventType string, data any) {
+	if err := a.store.Events.PublishEvent(ctx, userId, eventType, data); err != nil {
+		a.logger.Errorf("Could not publish %s to user %d: %v", eventType, userId, err)
+	}
+}
+
+// pushBalance sends the user's current balance to their open streams.
+func (a *application) pushBalance(ctx context.Context, userId int64) {
+	balance, err := a.store.Users.GetUserBalance(ctx, userId)
+	if err != nil {
+		a.logger.Errorf("Could not load balance of user %d: %v", userId, err)
+		return
+	}
+
+	a.publish(ctx, userId, types.EventBalanceUpdated, balance)
+}
+
+// pruneEvents periodically drops event logs that are too old to replay so
+// users who stopped listening do not keep theirs in memory.
+func (a *application) pruneEvents() {
+	ticker := time.NewTicker(eventLogTTL)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		a.hub.Prune()
 	}
 }
@@ -2,10 +2,10 @@ package api
 
 import (
 	"database/sql"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"strconv"
+	"time"
 
 	"github.com/brownei/chifunds-api/types"
 	"github.com/brownei/chifunds-api/utils"
@@ -15,11 +15,15 @@ import (
 
 func (a *application) AllTransactionRoutes(r chi.Router) {
 	r.Use(a.AuthMiddleware)
-	r.Post("/transfer-money", a.TransferFunds)
-	r.Post("/borrow-money", a.BorrowMoneyFromUs)
-	r.Get("/received", a.GetReceivedTransactions)
-	r.Get("/sent", a.GetSentTransactions)
-	r.Get("/borrowed", a.GetBorrowedTransactions)
+	r.With(a.RequireVerifiedEmail, a.IdempotencyMiddleware, a.MoneyEncryptionMiddleware).Post("/transfer-money", a.TransferFunds)
+	r.With(a.RequireVerifiedEmail, a.IdempotencyMiddleware, a.MoneyEncryptionMiddleware).Post("/borrow-money", a.BorrowMoneyFromUs)
+	r.Group(func(r chi.Router) {
+		r.Use(a.EncryptionMiddleware)
+		r.Get("/received", a.GetReceivedTransactions)
+		r.Get("/sent", a.GetSentTransactions)
+		r.Get("/borrowed", a.GetBorrowedTransactions)
+		r.Get("/holds", a.GetActiveHolds)
+	})
 }
 
 func (a *application) BorrowMoneyFromUs(w http.ResponseWriter, r *http.Request) {
@@ -27,15 +31,7 @@ func (a *application) BorrowMoneyFromUs(w http.ResponseWriter, r *http.Request)
 	ctx := r.Context()
 	email := ctx.Value("user").(string)
 
-	decryptedData, err := utils.DecryptAndParseJson(r, RsaDecrypt)
-	if err != nil {
-		a.logger.Errorf("DECRYT ERROR: %v", err)
-		utils.WriteError(w, http.StatusBadRequest, err)
-		return
-	}
-
-	if err := json.Unmarshal(decryptedData, &payload); err != nil {
-		a.logger.Errorf("Unmarshall data error: %v", err)
+	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
@@ -53,41 +49,34 @@ func (a *application) BorrowMoneyFromUs(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	if err := a.store.Transactions.BorrowMoney(ctx, a.logger, payload.Amount, int8(existingUser.ID)); err != nil {
+	loan, err := a.store.Transactions.BorrowMoney(ctx, a.logger, existingUser.ID, payload)
+	if err != nil {
 		a.logger.Info(err)
+		var codedErr *types.CodedError
+		if errors.As(err, &codedErr) {
+			utils.WriteError(w, http.StatusUnprocessableEntity, err)
+			return
+		}
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	balance, err := a.store.Users.GetBalance(ctx, existingUser.Email)
-	if err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err)
-		return
-	}
-	broadcastBalanceUpdate(strconv.Itoa(balance.Amount))
+	a.publish(ctx, existingUser.ID, types.EventLoanDisbursed, loan)
+	a.pushBalance(ctx, existingUser.ID)
 
-	utils.EncryptAndWriteJson(w, http.StatusAccepted, []byte("Successfully"), RsaEncrypt)
-	//utils.WriteJSON(w, http.StatusAccepted, "Successful")
+	utils.WriteJSON(w, http.StatusAccepted, loan)
 }
 
 func (a *application) TransferFunds(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	currentUserEmail := ctx.Value("user").(string)
 
-	decryptedData, err := utils.DecryptAndParseJson(r, RsaDecrypt)
-	if err != nil {
-		a.logger.Errorf("DECRYT ERROR: %v", err)
-		utils.WriteError(w, http.StatusBadRequest, err)
-		return
-	}
-
 	var payload types.TransferMoneyDto
-	if err := json.Unmarshal(decryptedData, &payload); err != nil {
+	if err := utils.ParseJSON(r, &payload); err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	a.logger.Info(payload)
 	if err := utils.Validator.Struct(payload); err != nil {
 		errors := err.(validator.ValidationErrors)
 		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
@@ -100,21 +89,30 @@ func (a *application) TransferFunds(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := a.store.Transactions.TransferMoney(ctx, a.logger, *existingUser, payload.Amount, payload.AccountNumber); err != nil {
-		utils.WriteError(w, http.StatusBadRequest, err)
+	if !a.checkTransferTotp(w, r, existingUser, payload) {
 		return
 	}
 
-	balance, err := a.store.Users.GetBalance(ctx, existingUser.Email)
+	transfer, err := a.store.Transactions.TransferMoney(ctx, a.logger, *existingUser, payload.Amount, payload.AccountNumber)
 	if err != nil {
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
 
-	broadcastBalanceUpdate(strconv.Itoa(balance.Amount))
-
-	utils.EncryptAndWriteJson(w, http.StatusAccepted, []byte("Successfully sent money"), RsaEncrypt)
-	//utils.WriteJSON(w, http.StatusOK, fmt.Sprintf("Successfully sent money"))
+	a.publish(ctx, transfer.SenderId, types.EventTransferSent, types.TransferEvent{
+		TransactionId: transfer.TransactionId,
+		Amount:        transfer.Amount,
+		Counterparty:  transfer.NameOfReceiver,
+	})
+	a.publish(ctx, transfer.ReceiverId, types.EventTransferReceived, types.TransferEvent{
+		TransactionId: transfer.TransactionId,
+		Amount:        transfer.Amount,
+		Counterparty:  fmt.Sprintf("%s %s", existingUser.FirstName, existingUser.LastName),
+	})
+	a.pushBalance(ctx, transfer.SenderId)
+	a.pushBalance(ctx, transfer.ReceiverId)
+
+	utils.WriteJSON(w, http.StatusAccepted, "Successfully sent money")
 }
 
 func (a *application) GetReceivedTransactions(w http.ResponseWriter, r *http.Request) {
@@ -137,8 +135,9 @@ func (a *application) GetReceivedTransactions(w http.ResponseWriter, r *http.Req
 
 func (a *application) GetBorrowedTransactions(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	email := ctx.Value("user").(string)
 
-	transactions, err := a.store.Transactions.GetBorrowedTransactions(ctx)
+	transactions, err := a.store.Transactions.GetBorrowedTransactions(ctx, email)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			utils.WriteJSON(w, http.StatusOK, fmt.Sprintf("You do not want to borow money yet"))
@@ -148,11 +147,85 @@ func (a *application) GetBorrowedTransactions(w http.ResponseWriter, r *http.Req
 		utils.WriteError(w, http.StatusBadRequest, err)
 		return
 	}
-	a.logger.Infof("Transactions Borrowed: %v", transactions)
-
 	utils.WriteJSON(w, http.StatusOK, transactions)
 }
 
+func (a *application) GetActiveHolds(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	holds, err := a.store.Holds.GetActiveHolds(ctx, existingUser.ID)
+	if err != nil {
+		a.logger.Info(err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, holds)
+}
+
+// GetAllBorrowers lists every user's loans for admins. It accepts optional
+// "from" and "to" dates (YYYY-MM-DD or RFC 3339) and a "status" filter. A "to"
+// given as a date includes the whole of that day.
+func (a *application) GetAllBorrowers(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	var filter types.BorrowerFilter
+
+	if from := r.URL.Query().Get("from"); from != "" {
+		parsed, _, err := parseDate(from)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid from date: %s", from))
+			return
+		}
+		filter.From = &parsed
+	}
+
+	if to := r.URL.Query().Get("to"); to != "" {
+		parsed, dateOnly, err := parseDate(to)
+		if err != nil {
+			utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid to date: %s", to))
+			return
+		}
+		if dateOnly {
+			parsed = parsed.AddDate(0, 0, 1)
+		}
+		filter.To = &parsed
+	}
+
+	filter.Status = r.URL.Query().Get("status")
+	switch filter.Status {
+	case "", types.LoanStatusActive, types.LoanStatusRepaid, types.LoanStatusOverdue:
+	default:
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid status: %s", filter.Status))
+		return
+	}
+
+	borrowers, err := a.store.Transactions.GetAllBorrowers(ctx, filter)
+	if err != nil {
+		a.logger.Info(err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, borrowers)
+}
+
+// parseDate reads a date or an RFC 3339 timestamp, reporting which it was.
+func parseDate(value string) (time.Time, bool, error) {
+	if parsed, err := time.Parse(time.DateOnly, value); err == nil {
+		return parsed, true, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	return parsed, false, err
+}
+
 func (a *application) GetSentTransactions(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
 	email := ctx.Value("user").(string)
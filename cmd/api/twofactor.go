@@ -0,0 +1,199 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"github.com/go-playground/validator/v10"
+)
+
+// totpIssuer names the account in authenticator apps.
+const totpIssuer = "ChiFunds"
+
+// transferTotpThreshold is the transfer amount above which users with
+// two-factor authentication need a fresh code, set with
+// TOTP_TRANSFER_THRESHOLD.
+func transferTotpThreshold() int32 {
+	if threshold, err := strconv.ParseInt(os.Getenv("TOTP_TRANSFER_THRESHOLD"), 10, 32); err == nil {
+		return int32(threshold)
+	}
+
+	return 100000
+}
+
+// EnrollTotp starts two-factor enrollment. The returned URI is shown as a QR
+// code for the user's authenticator app, which then confirms it with a code.
+func (a *application) EnrollTotp(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	secret, err := a.store.TwoFactor.BeginTotpEnrollment(ctx, existingUser.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.TotpEnrollment{
+		Secret:          secret,
+		ProvisioningUri: utils.TOTPURI(totpIssuer, existingUser.Email, secret),
+	})
+}
+
+// ConfirmTotp turns on two-factor authentication and answers with the
+// recovery codes, which are never shown again.
+func (a *application) ConfirmTotp(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	payload, ok := parseTotpCode(w, r)
+	if !ok {
+		return
+	}
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	codes, err := a.store.TwoFactor.ConfirmTotp(ctx, existingUser.ID, payload.Code)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, types.RecoveryCodes{RecoveryCodes: codes})
+}
+
+func (a *application) DisableTotp(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	payload, ok := parseTotpCode(w, r)
+	if !ok {
+		return
+	}
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	if !a.checkTotpAllowed(w, r, existingUser) {
+		return
+	}
+
+	if err := a.store.TwoFactor.DisableTotp(ctx, existingUser.ID, payload.Code); err != nil {
+		a.recordTotpFailure(r, existingUser, err)
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Two-factor authentication disabled")
+}
+
+// checkTransferTotp makes sure transfers above the threshold from users with
+// two-factor authentication carry a fresh code from their authenticator.
+// Recovery codes are not accepted here. It writes the error response and
+// returns false when the transfer may not go ahead; the idempotency key is
+// freed so the transfer can be sent again with a code.
+func (a *application) checkTransferTotp(w http.ResponseWriter, r *http.Request, user *types.User, payload types.TransferMoneyDto) bool {
+	ctx := r.Context()
+
+	if payload.Amount <= transferTotpThreshold() {
+		return true
+	}
+
+	enabled, err := a.store.TwoFactor.TotpEnabled(ctx, user.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return false
+	}
+
+	if !enabled {
+		return true
+	}
+
+	if payload.TotpCode == "" {
+		releaseIdempotencyKey(r)
+		utils.WriteError(w, http.StatusForbidden, &types.CodedError{Code: types.ErrorTwoFactorRequired, Message: "A two-factor code is required for this transfer"})
+		return false
+	}
+
+	if !a.checkTotpAllowed(w, r, user) {
+		releaseIdempotencyKey(r)
+		return false
+	}
+
+	if err := a.store.TwoFactor.VerifySecondFactor(ctx, user.ID, payload.TotpCode, false); err != nil {
+		a.recordTotpFailure(r, user, err)
+
+		var codedErr *types.CodedError
+		if errors.As(err, &codedErr) {
+			releaseIdempotencyKey(r)
+			utils.WriteError(w, http.StatusForbidden, err)
+			return false
+		}
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return false
+	}
+
+	return true
+}
+
+// checkTotpAllowed answers 429 while the user's sign ins are throttled or
+// their account is locked. Wrong codes from a signed in session count as
+// failed sign ins, so a stolen access token cannot guess codes any faster
+// than a password.
+func (a *application) checkTotpAllowed(w http.ResponseWriter, r *http.Request, user *types.User) bool {
+	throttle, err := a.store.LoginAttempts.CheckLoginAllowed(r.Context(), user.Email, clientIP(r))
+	if err != nil {
+		utils.WriteError(w, http.StatusInternalServerError, err)
+		return false
+	} else if throttle != nil {
+		writeLoginThrottle(w, throttle)
+		return false
+	}
+
+	return true
+}
+
+// recordTotpFailure counts err against the user when it is a wrong code.
+func (a *application) recordTotpFailure(r *http.Request, user *types.User, err error) {
+	var codedErr *types.CodedError
+	if !errors.As(err, &codedErr) || codedErr.Code != types.ErrorInvalidTwoFactorCode {
+		return
+	}
+
+	attempt := types.LoginAttempt{Email: user.Email, IP: clientIP(r), UserAgent: r.UserAgent(), Reason: "invalid_second_factor"}
+	a.recordLoginFailure(r.Context(), attempt, user)
+}
+
+func parseTotpCode(w http.ResponseWriter, r *http.Request) (types.TotpCodeDto, bool) {
+	var payload types.TotpCodeDto
+
+	if err := utils.ParseJSON(r, &payload); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return payload, false
+	}
+
+	if err := utils.Validator.Struct(payload); err != nil {
+		errors := err.(validator.ValidationErrors)
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Invalid payload: %v", errors))
+		return payload, false
+	}
+
+	return payload, true
+}
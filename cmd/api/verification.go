@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/brownei/chifunds-api/mailer"
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+)
+
+const (
+	purposeVerifyEmail = "verify_email"
+	// emailVerificationTTL is how long a verification link works.
+	emailVerificationTTL = 24 * time.Hour
+	// verificationResendInterval is the least time between two verification
+	// emails to the same user.
+	verificationResendInterval = time.Minute
+)
+
+var errVerificationRateLimited = errors.New("A verification email was sent recently, try again in a minute")
+
+// appURL is the public address of the API, used in links sent by email.
+func appURL() string {
+	if address := os.Getenv("APP_URL"); address != "" {
+		return address
+	}
+
+	return "https://chifunds-api.onrender.com"
+}
+
+// sendVerificationEmail emails the user a link that verifies their address.
+func (a *application) sendVerificationEmail(ctx context.Context, user *types.User) error {
+	claimed, err := a.store.Users.ClaimVerificationEmail(ctx, user.ID, verificationResendInterval)
+	if err != nil {
+		return err
+	} else if !claimed {
+		return errVerificationRateLimited
+	}
+
+	token, err := utils.PurposeToken(user.Email, purposeVerifyEmail, emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	link := fmt.Sprintf("%s/v1/auth/verify-email?token=%s", appURL(), url.QueryEscape(token))
+	return a.mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your ChiFunds email",
+		Body:    fmt.Sprintf("Hi %s,\n\nConfirm your email address to start sending and borrowing money:\n\n%s\n\nThe link expires in 24 hours.\n", user.FirstName, link),
+	})
+}
+
+// VerifyEmail verifies the address of the link's token. QueryTokenMiddleware
+// has already taken the token off the URL so it is not logged.
+func (a *application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	token, _ := ctx.Value("queryToken").(string)
+	if token == "" {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("No token"))
+		return
+	}
+
+	email, err := utils.VerifyPurposeToken(token, purposeVerifyEmail)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := a.store.Users.VerifyEmail(ctx, email); err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusOK, "Email verified")
+}
+
+func (a *application) ResendVerificationEmail(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	if existingUser.EmailVerified {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("Email is already verified"))
+		return
+	}
+
+	if err := a.sendVerificationEmail(ctx, existingUser); err != nil {
+		if errors.Is(err, errVerificationRateLimited) {
+			w.Header().Set("Retry-After", strconv.Itoa(int(verificationResendInterval.Seconds())))
+			utils.WriteError(w, http.StatusTooManyRequests, err)
+			return
+		}
+
+		a.logger.Errorf("Could not send verification email: %v", err)
+		utils.WriteError(w, http.StatusInternalServerError, fmt.Errorf("Could not send the verification email"))
+		return
+	}
+
+	utils.WriteJSON(w, http.StatusAccepted, "Verification email sent")
+}
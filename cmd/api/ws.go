@@ -0,0 +1,197 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// writeWait is how long a single write to a socket may take.
+	writeWait = 10 * time.Second
+	// pongWait is how long a socket may stay silent before it is considered
+	// dead. Pings are sent often enough for a live client to answer in time.
+	pongWait   = 60 * time.Second
+	pingPeriod = pongWait * 9 / 10
+	// maxSocketMessage bounds the subscription messages clients send.
+	maxSocketMessage = 4096
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	// Native clients send no Origin, browsers must come from one of the
+	// origins allowed by CORS.
+	CheckOrigin: func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		return origin == "" || slices.Contains(allowedOrigins, origin)
+	},
+}
+
+// Handler to send account events over a WebSocket. It delivers the same
+// events as the SSE route and lets the client narrow them down by type.
+func (a *application) WebSocketRoute(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	email := ctx.Value("user").(string)
+
+	existingUser, _ := a.store.Users.GetUsersByEmail(ctx, email, false)
+	if existingUser == nil {
+		utils.WriteError(w, http.StatusBadRequest, fmt.Errorf("There is no user like this"))
+		return
+	}
+
+	balance, err := a.store.Users.GetUserBalance(ctx, existingUser.ID)
+	if err != nil {
+		utils.WriteError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// The upgrader answers failed handshakes itself.
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		a.logger.Infof("WebSocket upgrade failed: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	client, missed := a.hub.Register(existingUser.ID, lastEventId(r))
+	defer a.hub.Unregister(existingUser.ID, client)
+
+	messages := make(chan types.SocketMessage)
+	replies := make(chan types.SocketReply)
+	done := make(chan struct{})
+	stop := make(chan struct{})
+	defer close(stop)
+	go readSocket(conn, messages, replies, done, stop)
+
+	ping := time.NewTicker(pingPeriod)
+	defer ping.Stop()
+
+	// The subscriptions are only touched here, so writes never race with the
+	// messages that change them. Every event goes out until the client sends
+	// its first message.
+	all := true
+	subscriptions := map[string]bool{}
+	send := func(message any) error {
+		conn.SetWriteDeadline(time.Now().Add(writeWait))
+		return conn.WriteJSON(message)
+	}
+
+	snapshot, _ := json.Marshal(balance)
+	if err := send(types.Event{Type: types.EventBalanceUpdated, Data: snapshot, CreatedAt: time.Now().UTC()}); err != nil {
+		return
+	}
+	for _, event := range missed {
+		if err := send(event); err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case event, ok := <-client.channel:
+			if !ok {
+				// The hub is closed when the server shuts down.
+				conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "Server is shutting down"), time.Now().Add(writeWait))
+				return
+			}
+
+			if !all && !subscriptions[event.Type] {
+				continue
+			}
+
+			if err := send(event); err != nil {
+				return
+			}
+		case message := <-messages:
+			if all {
+				all = false
+				if message.Action == types.SocketActionUnsubscribe {
+					for _, eventType := range types.EventTypes {
+						subscriptions[eventType] = true
+					}
+				}
+			}
+
+			for _, eventType := range message.Events {
+				if message.Action == types.SocketActionSubscribe {
+					subscriptions[eventType] = true
+				} else {
+					delete(subscriptions, eventType)
+				}
+			}
+
+			current := make([]string, 0, len(subscriptions))
+			for eventType := range subscriptions {
+				current = append(current, eventType)
+			}
+			sort.Strings(current)
+
+			if err := send(types.SocketReply{Type: "subscriptions", Events: current}); err != nil {
+				return
+			}
+		case reply := <-replies:
+			if err := send(reply); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				return
+			}
+		case <-done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// readSocket reads the client's messages until the connection fails or is
+// closed, or the writer stops. Valid messages go to messages, rejections to
+// replies.
+func readSocket(conn *websocket.Conn, messages chan<- types.SocketMessage, replies chan<- types.SocketReply, done chan<- struct{}, stop <-chan struct{}) {
+	defer close(done)
+
+	conn.SetReadLimit(maxSocketMessage)
+	conn.SetReadDeadline(time.Now().Add(pongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongWait))
+	})
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var message types.SocketMessage
+		var reply *types.SocketReply
+		if err := json.Unmarshal(data, &message); err != nil {
+			reply = &types.SocketReply{Type: "error", Message: "Invalid message"}
+		} else if err := utils.Validator.Struct(message); err != nil {
+			reply = &types.SocketReply{Type: "error", Message: fmt.Sprintf("Invalid message: %v", err)}
+		}
+
+		if reply != nil {
+			select {
+			case replies <- *reply:
+			case <-stop:
+				return
+			}
+			continue
+		}
+
+		select {
+		case messages <- message:
+		case <-stop:
+			return
+		}
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
 
 	"github.com/brownei/chifunds-api/cmd/api"
 	"github.com/brownei/chifunds-api/db"
@@ -20,7 +22,6 @@ func main() {
 	defer logger.Sync()
 
 	newDb, err := db.NewPostgresStorage()
-	store := store.NewStore(newDb)
 	if err != nil {
 		logger.Error("Database connection unsuccessful: %s", zap.Field{
 			Interface: err,
@@ -29,8 +30,33 @@ func main() {
 
 	db.InitializeDb(newDb, logger)
 	db.AddMigrations(newDb, logger)
-	if err := api.GenerateRSAKeys(); err != nil {
-		log.Printf("Error generating keys: %v", err)
+
+	keyProvider, err := store.NewKeyProvider()
+	if err != nil {
+		logger.Fatalf("Could not load the master key: %v", err)
+	}
+
+	cipher, err := store.NewFieldCipher(context.Background(), newDb, keyProvider)
+	if err != nil {
+		logger.Fatalf("Could not load the data keys: %v", err)
+	}
+
+	// Rows written before encryption have no blind index yet and cannot be
+	// looked up until they are encrypted.
+	if n, err := cipher.Reencrypt(context.Background()); err != nil {
+		logger.Fatalf("Could not encrypt existing rows: %v", err)
+	} else if n > 0 {
+		logger.Infof("Encrypted %d existing values", n)
+	}
+
+	store := store.NewStore(newDb, cipher)
+
+	// Keys stored before they were wrapped are wrapped before the server
+	// loads them.
+	if n, err := store.Keys.WrapEncryptionKeys(context.Background()); err != nil {
+		logger.Fatalf("Could not wrap the encryption keys: %v", err)
+	} else if n > 0 {
+		logger.Infof("Wrapped %d encryption keys", n)
 	}
 
 	if err := store.CreateChiFundsUser(); err != nil {
@@ -38,6 +64,16 @@ func main() {
 		return
 	}
 
+	// The first admin is an existing verified user named by ADMIN_EMAIL. Once
+	// there is an admin, roles are managed under /v1/admin instead.
+	if email := os.Getenv("ADMIN_EMAIL"); email != "" {
+		if promoted, err := store.Users.PromoteFirstAdmin(context.Background(), email); err != nil {
+			logger.Errorf("Could not promote ADMIN_EMAIL to admin: %v", err)
+		} else if promoted {
+			logger.Info("Promoted ADMIN_EMAIL to admin")
+		}
+	}
+
 	server := api.NewServer(":8000", logger, newDb, store)
 	if err := server.Run(); err != nil {
 		log.Printf("Cannot start up server: %s", err)
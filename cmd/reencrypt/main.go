@@ -0,0 +1,89 @@
+// Command reencrypt moves the encrypted columns onto the current keys. Run it
+// once with -init to create the master key, which the API refuses to start
+// without. Run it after rotating the field key with -rotate, or with -rewrap
+// after replacing the master key: create the new key with -init under a new
+// MASTER_KEY_FILE and list the old one in MASTER_KEY_PREVIOUS_FILES until it
+// has finished. Running API instances keep writing with the field key they
+// started with, so restart them after -rotate and run it once more.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/brownei/chifunds-api/db"
+	"github.com/brownei/chifunds-api/store"
+	_ "github.com/joho/godotenv/autoload"
+	"go.uber.org/zap"
+)
+
+func main() {
+	rotate := flag.Bool("rotate", false, "create a new field key and re-encrypt every value with it")
+	rewrap := flag.Bool("rewrap", false, "wrap the data and encryption keys with the current master key")
+	initKey := flag.Bool("init", false, "create the master key file before anything is encrypted")
+	flag.Parse()
+
+	zapLogger, err := zap.NewProduction()
+	if err != nil {
+		log.Fatalf("can't initialize zap logger: %v", err)
+	}
+	logger := zapLogger.Sugar()
+
+	defer logger.Sync()
+
+	if *initKey {
+		path, err := store.InitMasterKey()
+		if err != nil {
+			logger.Fatalf("Could not create the master key: %v", err)
+		}
+		logger.Infof("Created master key %s, every instance needs a copy of it and it must be backed up", path)
+	}
+
+	newDb, err := db.NewPostgresStorage()
+	if err != nil {
+		logger.Fatalf("Database connection unsuccessful: %v", err)
+	}
+
+	db.InitializeDb(newDb, logger)
+	db.AddMigrations(newDb, logger)
+
+	ctx := context.Background()
+
+	keyProvider, err := store.NewKeyProvider()
+	if err != nil {
+		logger.Fatalf("Could not load the master key: %v", err)
+	}
+
+	cipher, err := store.NewFieldCipher(ctx, newDb, keyProvider)
+	if err != nil {
+		logger.Fatalf("Could not load the data keys: %v", err)
+	}
+
+	if *rewrap {
+		n, err := cipher.RewrapDataKeys(ctx)
+		if err != nil {
+			logger.Fatalf("Could not rewrap the data keys: %v", err)
+		}
+		logger.Infof("Rewrapped %d data keys with master key %s", n, keyProvider.KeyId())
+
+		n, err = store.NewStore(newDb, cipher).Keys.WrapEncryptionKeys(ctx)
+		if err != nil {
+			logger.Fatalf("Could not rewrap the encryption keys: %v", err)
+		}
+		logger.Infof("Rewrapped %d encryption keys with master key %s", n, keyProvider.KeyId())
+	}
+
+	if *rotate {
+		if err := cipher.RotateDataKey(ctx); err != nil {
+			logger.Fatalf("Could not rotate the field key: %v", err)
+		}
+		logger.Infof("Created a new field key")
+	}
+
+	n, err := cipher.Reencrypt(ctx)
+	if err != nil {
+		logger.Fatalf("Could not re-encrypt: %v", err)
+	}
+	logger.Infof("Re-encrypted %d values", n)
+}
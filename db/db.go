@@ -17,9 +17,14 @@ var (
 	port     = os.Getenv("DB_PORT")
 )
 
+// ConnectionString is the DSN of the configured database. Besides the pool it
+// is used to open dedicated connections, such as the one listening for events.
+func ConnectionString() string {
+	return fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, name)
+}
+
 func NewPostgresStorage() (*sql.DB, error) {
-	connStr := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, name)
-	db, err := sql.Open("postgres", connStr)
+	db, err := sql.Open("postgres", ConnectionString())
 
 	return db, err
 }
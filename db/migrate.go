@@ -98,6 +98,312 @@ func AddMigrations(db *sql.DB, log *zap.SugaredLogger) {
 					`ALTER TABLE "transactions" DROP CONSTRAINT IF EXISTS "Transactions_senderId_fkey"`,
 				},
 			},
+
+			{
+				Id: "10",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "ledger_account" (id SERIAL PRIMARY KEY, code VARCHAR(64) NOT NULL UNIQUE, account_id INT NULL UNIQUE REFERENCES "account"("id"), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+					`INSERT INTO "ledger_account" (code) VALUES ('system:lending_pool'), ('system:opening_balance') ON CONFLICT (code) DO NOTHING`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "ledger_account"`,
+				},
+			},
+
+			{
+				Id: "11",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "journal_entry" (id SERIAL PRIMARY KEY, kind VARCHAR(32) NOT NULL, description VARCHAR(255), transaction_id INT NULL REFERENCES "transactions"("id"), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "journal_entry"`,
+				},
+			},
+
+			{
+				Id: "12",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "posting" (id SERIAL PRIMARY KEY, journal_entry_id INT NOT NULL REFERENCES "journal_entry"("id"), ledger_account_id INT NOT NULL REFERENCES "ledger_account"("id"), direction VARCHAR(6) NOT NULL CHECK (direction IN ('debit', 'credit')), amount BIGINT NOT NULL CHECK (amount > 0), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+					`CREATE INDEX IF NOT EXISTS "posting_ledger_account_id_idx" ON "posting" (ledger_account_id)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "posting"`,
+				},
+			},
+
+			{
+				Id: "13",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "idempotency_key" (id SERIAL PRIMARY KEY, user_id INT NOT NULL REFERENCES "user"("id"), key VARCHAR(255) NOT NULL, request_hash VARCHAR(64) NOT NULL, status_code INT NULL, response TEXT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, UNIQUE (user_id, key))`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "idempotency_key"`,
+				},
+			},
+
+			{
+				Id: "14",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "loan" (id SERIAL PRIMARY KEY, user_id INT NOT NULL REFERENCES "user"("id"), account_id INT NOT NULL REFERENCES "account"("id"), transaction_id INT NULL REFERENCES "transactions"("id"), principal BIGINT NOT NULL CHECK (principal > 0), interest_rate_bps INT NOT NULL DEFAULT 0, interest BIGINT NOT NULL DEFAULT 0, term_days INT NOT NULL, explanation TEXT, amount_repaid BIGINT NOT NULL DEFAULT 0, status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'repaid')), disbursed_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, due_at TIMESTAMP NOT NULL, repaid_at TIMESTAMP NULL)`,
+					`CREATE INDEX IF NOT EXISTS "loan_user_id_idx" ON "loan" (user_id)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "loan"`,
+				},
+			},
+
+			{
+				Id: "15",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "loan_repayment" (id SERIAL PRIMARY KEY, loan_id INT NOT NULL REFERENCES "loan"("id"), amount BIGINT NOT NULL CHECK (amount > 0), transaction_id INT NULL REFERENCES "transactions"("id"), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "loan_repayment"`,
+				},
+			},
+
+			{
+				Id: "16",
+				Up: []string{
+					`ALTER TABLE "card" ALTER COLUMN serial_no TYPE VARCHAR(19)`,
+					`ALTER TABLE "card" DROP COLUMN IF EXISTS cvc`,
+					`ALTER TABLE "card" ADD COLUMN IF NOT EXISTS cvc_hash VARCHAR(100)`,
+					`ALTER TABLE "card" ADD COLUMN IF NOT EXISTS status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'frozen', 'terminated'))`,
+					`ALTER TABLE "card" ADD COLUMN IF NOT EXISTS created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP`,
+					`ALTER TABLE "card" ADD COLUMN IF NOT EXISTS terminated_at TIMESTAMP NULL`,
+				},
+				Down: []string{
+					`ALTER TABLE "card" DROP COLUMN IF EXISTS terminated_at`,
+					`ALTER TABLE "card" DROP COLUMN IF EXISTS created_at`,
+					`ALTER TABLE "card" DROP COLUMN IF EXISTS status`,
+					`ALTER TABLE "card" DROP COLUMN IF EXISTS cvc_hash`,
+					`ALTER TABLE "card" ADD COLUMN IF NOT EXISTS cvc INT`,
+				},
+			},
+
+			{
+				Id: "17",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "card_authorization" (id SERIAL PRIMARY KEY, card_id INT NOT NULL REFERENCES "card"("id"), account_id INT NOT NULL REFERENCES "account"("id"), amount BIGINT NOT NULL CHECK (amount > 0), captured_amount BIGINT NOT NULL DEFAULT 0, merchant_name VARCHAR(100) NOT NULL, merchant_id VARCHAR(64), merchant_category VARCHAR(4), status VARCHAR(16) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'captured', 'voided')), transaction_id INT NULL REFERENCES "transactions"("id"), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+					`CREATE INDEX IF NOT EXISTS "card_authorization_pending_idx" ON "card_authorization" (account_id) WHERE status = 'pending'`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "card_authorization"`,
+				},
+			},
+
+			{
+				Id: "18",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "hold" (id SERIAL PRIMARY KEY, account_id INT NOT NULL REFERENCES "account"("id"), amount BIGINT NOT NULL CHECK (amount > 0), kind VARCHAR(32) NOT NULL, reference VARCHAR(64), status VARCHAR(16) NOT NULL DEFAULT 'active' CHECK (status IN ('active', 'released', 'consumed')), expires_at TIMESTAMP NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, settled_at TIMESTAMP NULL)`,
+					`CREATE INDEX IF NOT EXISTS "hold_active_idx" ON "hold" (account_id) WHERE status = 'active'`,
+					`ALTER TABLE "card_authorization" ADD COLUMN IF NOT EXISTS hold_id INT NULL REFERENCES "hold"("id")`,
+					`INSERT INTO "hold" (account_id, amount, kind, reference, expires_at) SELECT account_id, amount, 'card_authorization', id::TEXT, created_at + INTERVAL '7 days' FROM "card_authorization" WHERE status = 'pending' AND hold_id IS NULL`,
+					`UPDATE "card_authorization" AS ca SET hold_id = h.id FROM "hold" AS h WHERE h.kind = 'card_authorization' AND h.reference = ca.id::TEXT AND ca.hold_id IS NULL`,
+				},
+				Down: []string{
+					`ALTER TABLE "card_authorization" DROP COLUMN IF EXISTS hold_id`,
+					`DROP TABLE IF EXISTS "hold"`,
+				},
+			},
+
+			{
+				Id: "19",
+				Up: []string{
+					// Collisions were never caught before, so every account
+					// sharing a number with an older one is renumbered with a
+					// fresh check digit number before the index is built.
+					`DO $$
+					DECLARE
+						duplicate RECORD;
+						weights INT[] := ARRAY[3, 7, 3, 3, 7, 3, 3, 7, 3, 3, 7, 3];
+						serial TEXT;
+						total INT;
+						renumbered TEXT;
+					BEGIN
+						FOR duplicate IN SELECT id, account_number FROM (SELECT id, account_number, ROW_NUMBER() OVER (PARTITION BY account_number ORDER BY id) AS n FROM "account" WHERE account_number IS NOT NULL) AS a WHERE n > 1 LOOP
+							LOOP
+								serial := LPAD(FLOOR(RANDOM() * 1000000000)::BIGINT::TEXT, 9, '0');
+								CONTINUE WHEN serial LIKE '512%';
+								total := 0;
+								FOR i IN 1..12 LOOP
+									total := total + SUBSTR('512' || serial, i, 1)::INT * weights[i];
+								END LOOP;
+								renumbered := serial || ((10 - total % 10) % 10)::TEXT;
+								EXIT WHEN NOT EXISTS (SELECT 1 FROM "account" WHERE account_number = renumbered);
+							END LOOP;
+							UPDATE "account" SET account_number = renumbered WHERE id = duplicate.id;
+							RAISE NOTICE 'Renumbered account % from % to %', duplicate.id, duplicate.account_number, renumbered;
+						END LOOP;
+					END
+					$$`,
+					`CREATE UNIQUE INDEX IF NOT EXISTS "account_account_number_key" ON "account" (account_number)`,
+					// Numbers from before check digits cannot be validated, so
+					// only the ones that exist now are accepted.
+					`ALTER TABLE "account" ADD COLUMN IF NOT EXISTS legacy_number BOOLEAN NOT NULL DEFAULT FALSE`,
+					`UPDATE "account" SET legacy_number = TRUE WHERE account_number LIKE '512%'`,
+				},
+				Down: []string{
+					`ALTER TABLE "account" DROP COLUMN IF EXISTS legacy_number`,
+					`DROP INDEX IF EXISTS "account_account_number_key"`,
+				},
+			},
+
+			{
+				Id: "20",
+				Up: []string{
+					// Start past the millisecond timestamps the in-process ids
+					// used so clients resuming from one still get new events.
+					`CREATE SEQUENCE IF NOT EXISTS "event_id_seq"`,
+					`SELECT setval('event_id_seq', (EXTRACT(EPOCH FROM CURRENT_TIMESTAMP) * 1000)::BIGINT)`,
+				},
+				Down: []string{
+					`DROP SEQUENCE IF EXISTS "event_id_seq"`,
+				},
+			},
+
+			{
+				Id: "21",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "auth_session" (id SERIAL PRIMARY KEY, user_id INT NOT NULL REFERENCES "user"("id"), created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, last_used_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, revoked_at TIMESTAMP NULL, revoked_reason VARCHAR(32) NULL)`,
+					`CREATE INDEX IF NOT EXISTS "auth_session_user_idx" ON "auth_session" (user_id)`,
+					`CREATE TABLE IF NOT EXISTS "refresh_token" (id SERIAL PRIMARY KEY, session_id INT NOT NULL REFERENCES "auth_session"("id"), token_hash VARCHAR(64) NOT NULL UNIQUE, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, expires_at TIMESTAMP NOT NULL, used_at TIMESTAMP NULL, replaced_by INT NULL REFERENCES "refresh_token"("id"))`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "refresh_token"`,
+					`DROP TABLE IF EXISTS "auth_session"`,
+				},
+			},
+
+			{
+				Id: "22",
+				Up: []string{
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS verification_sent_at TIMESTAMP NULL`,
+				},
+				Down: []string{
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS verification_sent_at`,
+				},
+			},
+
+			{
+				Id: "23",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "password_reset_token" (id SERIAL PRIMARY KEY, user_id INT NOT NULL REFERENCES "user"("id"), token_hash VARCHAR(64) NOT NULL UNIQUE, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, expires_at TIMESTAMP NOT NULL, used_at TIMESTAMP NULL)`,
+					`CREATE INDEX IF NOT EXISTS "password_reset_token_user_idx" ON "password_reset_token" (user_id) WHERE used_at IS NULL`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "password_reset_token"`,
+				},
+			},
+
+			{
+				Id: "24",
+				Up: []string{
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NULL`,
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_enabled BOOLEAN NOT NULL DEFAULT FALSE`,
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS totp_last_counter BIGINT NULL`,
+					`CREATE TABLE IF NOT EXISTS "recovery_code" (id SERIAL PRIMARY KEY, user_id INT NOT NULL REFERENCES "user"("id"), code_hash VARCHAR(64) NOT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, used_at TIMESTAMP NULL, UNIQUE (user_id, code_hash))`,
+					`CREATE TABLE IF NOT EXISTS "signin_challenge" (id SERIAL PRIMARY KEY, user_id INT NOT NULL REFERENCES "user"("id"), token_hash VARCHAR(64) NOT NULL UNIQUE, failed_attempts INT NOT NULL DEFAULT 0, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, expires_at TIMESTAMP NOT NULL, used_at TIMESTAMP NULL)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "signin_challenge"`,
+					`DROP TABLE IF EXISTS "recovery_code"`,
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS totp_last_counter`,
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS totp_enabled`,
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS totp_secret`,
+				},
+			},
+
+			{
+				Id: "25",
+				Up: []string{
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS role VARCHAR(16) NOT NULL DEFAULT 'user' CHECK (role IN ('user', 'support', 'admin'))`,
+				},
+				Down: []string{
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS role`,
+				},
+			},
+
+			{
+				Id: "26",
+				Up: []string{
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS failed_login_count INT NOT NULL DEFAULT 0`,
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS last_failed_login_at TIMESTAMP NULL`,
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP NULL`,
+					`CREATE TABLE IF NOT EXISTS "login_attempt" (id SERIAL PRIMARY KEY, user_id INT NULL REFERENCES "user"("id"), email VARCHAR(100) NOT NULL, ip VARCHAR(64) NOT NULL, user_agent VARCHAR(255), succeeded BOOLEAN NOT NULL, reason VARCHAR(32) NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+					`CREATE INDEX IF NOT EXISTS "login_attempt_ip_idx" ON "login_attempt" (ip, created_at) WHERE NOT succeeded`,
+					`CREATE INDEX IF NOT EXISTS "login_attempt_user_idx" ON "login_attempt" (user_id, created_at)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "login_attempt"`,
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS locked_until`,
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS last_failed_login_at`,
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS failed_login_count`,
+				},
+			},
+
+			{
+				Id: "27",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "encryption_key" (kid VARCHAR(64) PRIMARY KEY, private_key TEXT NOT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, retires_at TIMESTAMP NULL)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "encryption_key"`,
+				},
+			},
+
+			{
+				Id: "28",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "payload_nonce" (nonce VARCHAR(128) PRIMARY KEY, expires_at TIMESTAMP NOT NULL)`,
+					`CREATE INDEX IF NOT EXISTS "payload_nonce_expires_at_idx" ON "payload_nonce" (expires_at)`,
+				},
+				Down: []string{
+					`DROP TABLE IF EXISTS "payload_nonce"`,
+				},
+			},
+
+			{
+				Id: "29",
+				Up: []string{
+					`CREATE TABLE IF NOT EXISTS "data_key" (id SERIAL PRIMARY KEY, purpose VARCHAR(16) NOT NULL CHECK (purpose IN ('field', 'blind_index')), master_key_id VARCHAR(64) NOT NULL, wrapped_key TEXT NOT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP)`,
+					`ALTER TABLE "user" ALTER COLUMN email TYPE TEXT, ALTER COLUMN first_name TYPE TEXT, ALTER COLUMN last_name TYPE TEXT`,
+					`ALTER TABLE "user" ADD COLUMN IF NOT EXISTS email_index VARCHAR(64) UNIQUE`,
+					`ALTER TABLE "card" ALTER COLUMN serial_no TYPE TEXT`,
+					`ALTER TABLE "card" ADD COLUMN IF NOT EXISTS serial_no_index VARCHAR(64) UNIQUE`,
+					`ALTER TABLE "login_attempt" ALTER COLUMN email TYPE TEXT`,
+					// Keys without a master key id are still in plaintext and
+					// get wrapped at the next boot.
+					`ALTER TABLE "encryption_key" ADD COLUMN IF NOT EXISTS master_key_id VARCHAR(64) NULL`,
+				},
+				Down: []string{
+					`ALTER TABLE "encryption_key" DROP COLUMN IF EXISTS master_key_id`,
+					`ALTER TABLE "card" DROP COLUMN IF EXISTS serial_no_index`,
+					`ALTER TABLE "user" DROP COLUMN IF EXISTS email_index`,
+					`DROP TABLE IF EXISTS "data_key"`,
+				},
+			},
+
+			{
+				Id: "30",
+				Up: []string{
+					// The system user sent loan disbursements only. It was
+					// seeded as an admin with a password that is public, so
+					// it loses both.
+					`UPDATE "user" SET role = 'user', password = '!' WHERE id = 1`,
+				},
+				Down: []string{},
+			},
+
+			{
+				Id: "31",
+				Up: []string{
+					`ALTER TABLE "idempotency_key" ADD COLUMN IF NOT EXISTS response_headers TEXT NULL`,
+				},
+				Down: []string{
+					`ALTER TABLE "idempotency_key" DROP COLUMN IF EXISTS response_headers`,
+				},
+			},
 		},
 	}
 
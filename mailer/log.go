@@ -0,0 +1,34 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// LogMailer is the development mailer. It logs every email and, when Dir is
+// set, also writes it there as an .eml file.
+type LogMailer struct {
+	Logger *zap.SugaredLogger
+	Dir    string
+	From   string
+}
+
+func (m *LogMailer) Send(ctx context.Context, message Message) error {
+	m.Logger.Infof("Email to %s: %s\n%s", message.To, message.Subject, message.Body)
+
+	if m.Dir == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(m.Dir, 0o755); err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), message.To)
+	return os.WriteFile(filepath.Join(m.Dir, name), render(m.From, message), 0o644)
+}
@@ -0,0 +1,41 @@
+package mailer
+
+import (
+	"context"
+	"os"
+
+	"go.uber.org/zap"
+)
+
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends transactional emails such as verification links.
+type Mailer interface {
+	Send(ctx context.Context, message Message) error
+}
+
+// New picks the mailer from the environment. MAILER=smtp sends through the
+// SMTP server in SMTP_HOST; anything else writes emails to the log, and to
+// MAIL_DIR when it is set, so links can be followed in local development.
+func New(logger *zap.SugaredLogger) Mailer {
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		from = "ChiFunds <no-reply@chifunds.app>"
+	}
+
+	if os.Getenv("MAILER") == "smtp" {
+		return &SMTPMailer{
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     from,
+		}
+	}
+
+	return &LogMailer{Logger: logger, Dir: os.Getenv("MAIL_DIR"), From: from}
+}
@@ -4,22 +4,371 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"time"
 
 	"github.com/brownei/chifunds-api/types"
 	"github.com/brownei/chifunds-api/utils"
 )
 
+// refreshTokenTTL is how long a refresh token can be used. Every refresh
+// replaces it, so a session stays open as long as it is used this often.
+const refreshTokenTTL = 30 * 24 * time.Hour
+
+// passwordResetTTL is how long an emailed password reset link works.
+const passwordResetTTL = time.Hour
+
+// signInChallengeTTL is how long a user has to enter their two-factor code
+// after their password was accepted.
+const signInChallengeTTL = 5 * time.Minute
+
+// signInChallengeAttempts is how many wrong codes a sign in challenge takes
+// before it is used up and the user has to sign in again.
+const signInChallengeAttempts = 5
+
+const (
+	revokedLogout        = "logout"
+	revokedReuse         = "refresh_token_reuse"
+	revokedPasswordReset = "password_reset"
+	revokedAdmin         = "admin"
+	revokedRoleChange    = "role_change"
+)
+
+var (
+	errInvalidRefreshToken = fmt.Errorf("Invalid refresh token")
+	errInvalidResetToken   = fmt.Errorf("Invalid or expired reset link")
+	errInvalidChallenge    = fmt.Errorf("Invalid or expired sign in challenge, sign in again")
+)
+
 type AuthStore struct {
-	store *sql.DB
+	store  *sql.DB
+	cipher *FieldCipher
 }
 
-func (s *AuthStore) Login(ctx context.Context, existingUser *types.User, payload types.LoginPayload) (string, error) {
+// Login checks the user's password. Users with two-factor authentication get
+// a challenge to complete with CompleteTwoFactorSignIn instead of tokens.
+func (s *AuthStore) Login(ctx context.Context, existingUser *types.User, payload types.LoginPayload) (*types.AuthTokens, *types.SignInChallenge, error) {
 	//Get the user from the database
 	if err := utils.VerifyPassword(existingUser.Password, payload.Password); err != nil {
-		return "Not verified", fmt.Errorf(err.Error())
+		return nil, nil, ErrInvalidCredentials
+	}
+
+	return s.SignIn(ctx, existingUser)
+}
+
+// SignIn starts a session for a user whose identity was already proven, by
+// their password or a login provider, or hands back a challenge when they
+// have two-factor authentication on.
+func (s *AuthStore) SignIn(ctx context.Context, existingUser *types.User) (*types.AuthTokens, *types.SignInChallenge, error) {
+	var totpEnabled bool
+	if err := s.store.QueryRowContext(ctx, `SELECT totp_enabled FROM "user" WHERE id = $1`, existingUser.ID).Scan(&totpEnabled); err != nil {
+		return nil, nil, err
+	}
+
+	if totpEnabled {
+		challenge, err := s.createSignInChallenge(ctx, existingUser.ID)
+		return nil, challenge, err
+	}
+
+	tokens, err := s.CreateSession(ctx, existingUser.ID, existingUser.Email)
+	return tokens, nil, err
+}
+
+// createSignInChallenge stores a challenge for the user to answer with a
+// second factor. Only its hash is kept, like refresh tokens.
+func (s *AuthStore) createSignInChallenge(ctx context.Context, userId int64) (*types.SignInChallenge, error) {
+	token, hash := utils.NewSecretToken()
+
+	query := `INSERT INTO "signin_challenge" (user_id, token_hash, expires_at) VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))`
+	if _, err := s.store.ExecContext(ctx, query, userId, hash, signInChallengeTTL.Seconds()); err != nil {
+		return nil, err
+	}
+
+	return &types.SignInChallenge{
+		TwoFactorRequired: true,
+		ChallengeToken:    token,
+		ExpiresIn:         int(signInChallengeTTL.Seconds()),
+	}, nil
+}
+
+// CompleteTwoFactorSignIn finishes a sign in that was answered with a
+// challenge. The code may be a TOTP code or one of the user's recovery codes.
+// A challenge works once, and is used up after signInChallengeAttempts wrong
+// codes so the code cannot be guessed. It returns the email of the user the
+// challenge belongs to, also when the code was wrong, so the attempt can be
+// counted against them; a locked account cannot complete its challenge.
+func (s *AuthStore) CompleteTwoFactorSignIn(ctx context.Context, challengeToken string, code string) (*types.AuthTokens, string, error) {
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer tx.Rollback()
+
+	var challengeId, userId int64
+	var email string
+	query := `SELECT c.id, c.user_id, u.email FROM "signin_challenge" AS c JOIN "user" AS u ON u.id = c.user_id WHERE c.token_hash = $1 AND c.used_at IS NULL AND c.expires_at > CURRENT_TIMESTAMP AND (u.locked_until IS NULL OR u.locked_until <= CURRENT_TIMESTAMP) FOR UPDATE OF c`
+	if err := tx.QueryRowContext(ctx, query, utils.HashToken(challengeToken)).Scan(&challengeId, &userId, s.cipher.Decrypting(fieldUserEmail, &email)); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, "", errInvalidChallenge
+		}
+		return nil, "", err
+	}
+
+	if err := verifySecondFactor(ctx, tx, userId, code, true); err != nil {
+		if err != errInvalidSecondFactor {
+			return nil, "", err
+		}
+
+		query := `UPDATE "signin_challenge" SET failed_attempts = failed_attempts + 1, used_at = CASE WHEN failed_attempts + 1 >= $1 THEN CURRENT_TIMESTAMP END WHERE id = $2`
+		if _, err := tx.ExecContext(ctx, query, signInChallengeAttempts, challengeId); err != nil {
+			return nil, "", err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, "", err
+		}
+
+		return nil, email, errInvalidSecondFactor
 	}
 
-	token := utils.JwtToken(payload.Email, ctx)
+	if _, err := tx.ExecContext(ctx, `UPDATE "signin_challenge" SET used_at = CURRENT_TIMESTAMP WHERE id = $1`, challengeId); err != nil {
+		return nil, "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, "", err
+	}
+
+	tokens, err := s.CreateSession(ctx, userId, email)
+	return tokens, email, err
+}
+
+// CreateSession starts a session for the user. The session is the family of
+// every refresh token issued from this sign in; revoking it signs out every
+// token of the family at once.
+func (s *AuthStore) CreateSession(ctx context.Context, userId int64, email string) (*types.AuthTokens, error) {
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var sessionId int64
+	var role string
+	query := `INSERT INTO "auth_session" (user_id) VALUES ($1) RETURNING id, (SELECT role FROM "user" WHERE id = $1)`
+	if err := tx.QueryRowContext(ctx, query, userId).Scan(&sessionId, &role); err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := issueRefreshToken(ctx, tx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return authTokens(email, sessionId, role, refreshToken)
+}
+
+// RefreshSession swaps a refresh token for a new pair of tokens. Each refresh
+// token works once: presenting one that was already used means it was copied,
+// so the whole session is revoked and both holders have to sign in again.
+func (s *AuthStore) RefreshSession(ctx context.Context, refreshToken string) (*types.AuthTokens, error) {
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var tokenId, sessionId int64
+	var email, role string
+	var used, expired, revoked bool
+	query := `SELECT rt.id, rt.session_id, u.email, u.role, rt.used_at IS NOT NULL, rt.expires_at <= CURRENT_TIMESTAMP, s.revoked_at IS NOT NULL FROM "refresh_token" AS rt JOIN "auth_session" AS s ON s.id = rt.session_id JOIN "user" AS u ON u.id = s.user_id WHERE rt.token_hash = $1 FOR UPDATE OF rt, s`
+	if err := tx.QueryRowContext(ctx, query, utils.HashToken(refreshToken)).Scan(&tokenId, &sessionId, s.cipher.Decrypting(fieldUserEmail, &email), &role, &used, &expired, &revoked); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, errInvalidRefreshToken
+		}
+		return nil, err
+	}
+
+	if revoked || expired {
+		return nil, errInvalidRefreshToken
+	}
+
+	if used {
+		if err := revokeSession(ctx, tx, sessionId, revokedReuse); err != nil {
+			return nil, err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+
+		return nil, errInvalidRefreshToken
+	}
+
+	newToken, err := issueRefreshToken(ctx, tx, sessionId)
+	if err != nil {
+		return nil, err
+	}
+
+	query = `UPDATE "refresh_token" SET used_at = CURRENT_TIMESTAMP, replaced_by = (SELECT id FROM "refresh_token" WHERE token_hash = $1) WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, query, utils.HashToken(newToken), tokenId); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "auth_session" SET last_used_at = CURRENT_TIMESTAMP WHERE id = $1`, sessionId); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return authTokens(email, sessionId, role, newToken)
+}
+
+// Logout revokes the session the access token was issued for.
+func (s *AuthStore) Logout(ctx context.Context, sessionId int64) error {
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeSession(ctx, tx, sessionId, revokedLogout); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// SessionActive reports whether the session can still be used.
+func (s *AuthStore) SessionActive(ctx context.Context, sessionId int64) (bool, error) {
+	var active bool
+	query := `SELECT EXISTS (SELECT 1 FROM "auth_session" WHERE id = $1 AND revoked_at IS NULL)`
+	if err := s.store.QueryRowContext(ctx, query, sessionId).Scan(&active); err != nil {
+		return false, err
+	}
+
+	return active, nil
+}
+
+// CreatePasswordReset issues a reset token for the user. Only the latest one
+// works: requesting another invalidates the tokens sent before it.
+func (s *AuthStore) CreatePasswordReset(ctx context.Context, userId int64) (string, error) {
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "password_reset_token" SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND used_at IS NULL`, userId); err != nil {
+		return "", err
+	}
+
+	token, hash := utils.NewSecretToken()
+	query := `INSERT INTO "password_reset_token" (user_id, token_hash, expires_at) VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))`
+	if _, err := tx.ExecContext(ctx, query, userId, hash, passwordResetTTL.Seconds()); err != nil {
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	return token, nil
+}
+
+// ResetPassword sets a new password with a reset token. The token is used up,
+// and every session of the user is revoked so whoever knew the old password
+// is signed out.
+func (s *AuthStore) ResetPassword(ctx context.Context, token string, password string) error {
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userId int64
+	query := `UPDATE "password_reset_token" SET used_at = CURRENT_TIMESTAMP WHERE token_hash = $1 AND used_at IS NULL AND expires_at > CURRENT_TIMESTAMP RETURNING user_id`
+	if err := tx.QueryRowContext(ctx, query, utils.HashToken(token)).Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			return errInvalidResetToken
+		}
+		return err
+	}
+
+	if err := updatePassword(ctx, tx, userId, password); err != nil {
+		return err
+	}
+
+	if err := revokeUserSessions(ctx, tx, userId, revokedPasswordReset); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func issueRefreshToken(ctx context.Context, tx *sql.Tx, sessionId int64) (string, error) {
+	token, hash := utils.NewSecretToken()
+
+	query := `INSERT INTO "refresh_token" (session_id, token_hash, expires_at) VALUES ($1, $2, CURRENT_TIMESTAMP + make_interval(secs => $3))`
+	if _, err := tx.ExecContext(ctx, query, sessionId, hash, refreshTokenTTL.Seconds()); err != nil {
+		return "", err
+	}
 
 	return token, nil
 }
+
+// revokeSession revokes the session, which also stops its refresh tokens from
+// being used. Revoking a session twice keeps the first reason.
+func revokeSession(ctx context.Context, tx *sql.Tx, sessionId int64, reason string) error {
+	query := `UPDATE "auth_session" SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $1 WHERE id = $2 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, reason, sessionId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// RevokeUserSessions signs the user out everywhere, for example when their
+// account is compromised.
+func (s *AuthStore) RevokeUserSessions(ctx context.Context, userId int64) error {
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := revokeUserSessions(ctx, tx, userId, revokedAdmin); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revokeUserSessions revokes every open session of the user.
+func revokeUserSessions(ctx context.Context, tx *sql.Tx, userId int64, reason string) error {
+	query := `UPDATE "auth_session" SET revoked_at = CURRENT_TIMESTAMP, revoked_reason = $1 WHERE user_id = $2 AND revoked_at IS NULL`
+	if _, err := tx.ExecContext(ctx, query, reason, userId); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func authTokens(email string, sessionId int64, role string, refreshToken string) (*types.AuthTokens, error) {
+	accessToken, err := utils.AccessToken(email, sessionId, role)
+	if err != nil {
+		return nil, err
+	}
+
+	return &types.AuthTokens{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(utils.AccessTokenTTL.Seconds()),
+	}, nil
+}
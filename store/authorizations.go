@@ -0,0 +1,306 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// CardSettlementAccount collects the money captured from card payments until
+// it is paid out to merchants.
+const CardSettlementAccount = "system:card_settlement"
+
+const journalKindCardCapture = "card_capture"
+
+// authorizationHoldTTL is how long an uncaptured authorization keeps its
+// money reserved.
+const authorizationHoldTTL = 7 * 24 * time.Hour
+
+const authorizationColumns = `id, card_id, amount, captured_amount, merchant_name, COALESCE(merchant_id, ''), COALESCE(merchant_category, ''), status, created_at, updated_at`
+
+type CardAuthorizationStore struct {
+	db     *sql.DB
+	cipher *FieldCipher
+}
+
+// AuthorizeCard validates the card details and, when the linked account can
+// cover the amount, places a pending authorization that holds the money until
+// it is captured or voided.
+func (s *CardAuthorizationStore) AuthorizeCard(ctx context.Context, payload types.CardAuthorizationDto) (*types.CardAuthorization, error) {
+	invalidCard := &types.CodedError{Code: types.DeclineInvalidCard, Message: "Invalid card details"}
+	if !utils.ValidLuhn(payload.Number) {
+		return nil, invalidCard
+	}
+
+	var cardId, accountId, userId int64
+	var cvcHash, status string
+	var expiry time.Time
+	query := `SELECT c.id, c.account_id, a.user_id, COALESCE(c.cvc_hash, ''), c.expiry_date, c.status FROM "card" AS c JOIN "account" AS a ON a.id = c.account_id WHERE c.serial_no_index = $1`
+	if err := s.db.QueryRowContext(ctx, query, s.cipher.BlindIndex(fieldCardSerialNo, payload.Number)).Scan(&cardId, &accountId, &userId, &cvcHash, &expiry, &status); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, invalidCard
+		}
+		return nil, err
+	}
+
+	if int(expiry.Month()) != payload.ExpiryMonth || expiry.Year() != payload.ExpiryYear {
+		return nil, invalidCard
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(cvcHash), []byte(payload.Cvc)); err != nil {
+		return nil, invalidCard
+	}
+
+	// A card is valid until the end of its expiry month.
+	if !time.Now().UTC().Before(expiry.AddDate(0, 1, 0)) {
+		return nil, &types.CodedError{Code: types.DeclineCardExpired, Message: "This card has expired"}
+	}
+
+	switch status {
+	case types.CardStatusFrozen:
+		return nil, &types.CodedError{Code: types.DeclineCardFrozen, Message: "This card is frozen"}
+	case types.CardStatusTerminated:
+		return nil, &types.CodedError{Code: types.DeclineCardTerminated, Message: "This card has been terminated"}
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	accounts, err := lockAccounts(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	available, err := availableBalance(ctx, tx, accounts[userId])
+	if err != nil {
+		return nil, err
+	}
+
+	if int64(payload.Amount) > available {
+		return nil, &types.CodedError{Code: types.DeclineInsufficientFunds, Message: "Insufficient funds"}
+	}
+
+	query = `INSERT INTO "card_authorization" (card_id, account_id, amount, merchant_name, merchant_id, merchant_category) VALUES ($1, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')) RETURNING ` + authorizationColumns
+	authorization, err := scanAuthorization(tx.QueryRowContext(ctx, query, cardId, accountId, payload.Amount, payload.MerchantName, payload.MerchantId, payload.MerchantCategory))
+	if err != nil {
+		return nil, err
+	}
+
+	holdId, err := placeHold(ctx, tx, accountId, authorization.Amount, types.HoldKindCardAuthorization, strconv.FormatInt(authorization.Id, 10), authorizationHoldTTL)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "card_authorization" SET hold_id = $1 WHERE id = $2`, holdId, authorization.Id); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return authorization, nil
+}
+
+func (s *CardAuthorizationStore) GetAuthorization(ctx context.Context, authorizationId int64) (*types.CardAuthorization, error) {
+	query := `SELECT ` + authorizationColumns + ` FROM "card_authorization" WHERE id = $1`
+
+	authorization, err := scanAuthorization(s.db.QueryRowContext(ctx, query, authorizationId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No authorization like this!")
+		}
+		return nil, err
+	}
+
+	return authorization, nil
+}
+
+// CaptureAuthorization settles a pending authorization, moving the money out of
+// the cardholder's account. An amount of zero captures the full authorized
+// amount; any remainder is released.
+func (s *CardAuthorizationStore) CaptureAuthorization(ctx context.Context, logger *zap.SugaredLogger, authorizationId int64, amount int32) (*types.CardAuthorization, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var userId int64
+	query := `SELECT a.user_id FROM "card_authorization" AS ca JOIN "account" AS a ON a.id = ca.account_id WHERE ca.id = $1`
+	if err := tx.QueryRowContext(ctx, query, authorizationId).Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No authorization like this!")
+		}
+		return nil, err
+	}
+
+	accounts, err := lockAccounts(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	account := accounts[userId]
+
+	authorization, err := scanAuthorization(tx.QueryRowContext(ctx, `SELECT `+authorizationColumns+` FROM "card_authorization" WHERE id = $1 FOR UPDATE`, authorizationId))
+	if err != nil {
+		return nil, err
+	}
+
+	var holdId sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT hold_id FROM "card_authorization" WHERE id = $1`, authorizationId).Scan(&holdId); err != nil {
+		return nil, err
+	}
+
+	if authorization.Status != types.AuthorizationStatusPending {
+		return nil, fmt.Errorf("This authorization is already %s", authorization.Status)
+	}
+
+	captured := int64(amount)
+	if captured == 0 {
+		captured = authorization.Amount
+	}
+
+	if captured > authorization.Amount {
+		return nil, fmt.Errorf("Cannot capture more than the authorized %d", authorization.Amount)
+	}
+
+	// The authorization's own hold is about to be consumed, so only the other
+	// holds on the account limit what can be captured.
+	available, err := availableBalance(ctx, tx, account)
+	if err != nil {
+		return nil, err
+	}
+
+	// Once the hold has expired the money is no longer reserved, so the
+	// authorization can only be voided.
+	if holdId.Valid {
+		var ownHold int64
+		var active bool
+		query := `SELECT amount, ` + activeHold + ` FROM "hold" WHERE id = $1`
+		if err := tx.QueryRowContext(ctx, query, holdId.Int64).Scan(&ownHold, &active); err != nil {
+			return nil, err
+		}
+		if !active {
+			return nil, fmt.Errorf("This authorization has expired")
+		}
+		available += ownHold
+	}
+
+	if captured > available {
+		return nil, &types.CodedError{Code: types.DeclineInsufficientFunds, Message: "Insufficient funds"}
+	}
+
+	var transactionId int64
+	query = `INSERT INTO "transactions" (receiver_id, sender_id, amount_sent) VALUES (NULL, $1, $2) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, userId, captured).Scan(&transactionId); err != nil {
+		return nil, err
+	}
+
+	settlement, err := systemLedgerAccount(ctx, tx, CardSettlementAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	cardholder, err := ledgerAccountForAccount(ctx, tx, account.id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = postJournalEntry(ctx, tx, types.JournalEntry{
+		Kind:          journalKindCardCapture,
+		Description:   fmt.Sprintf("Card payment to %s for authorization %d", authorization.MerchantName, authorizationId),
+		TransactionId: transactionId,
+		Postings: []types.Posting{
+			{LedgerAccountId: cardholder, Direction: types.PostingDebit, Amount: captured},
+			{LedgerAccountId: settlement, Direction: types.PostingCredit, Amount: captured},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if holdId.Valid {
+		if err := settleHold(ctx, tx, holdId.Int64, types.HoldStatusConsumed); err != nil {
+			return nil, err
+		}
+	}
+
+	query = `UPDATE "card_authorization" SET status = 'captured', captured_amount = $1, transaction_id = $2, updated_at = CURRENT_TIMESTAMP WHERE id = $3 RETURNING ` + authorizationColumns
+	authorization, err = scanAuthorization(tx.QueryRowContext(ctx, query, captured, transactionId, authorizationId))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Captured %d on card authorization %d", captured, authorizationId)
+	return authorization, nil
+}
+
+// VoidAuthorization cancels a pending authorization and releases its hold.
+func (s *CardAuthorizationStore) VoidAuthorization(ctx context.Context, authorizationId int64) (*types.CardAuthorization, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE "card_authorization" SET status = 'voided', updated_at = CURRENT_TIMESTAMP WHERE id = $1 AND status = 'pending' RETURNING ` + authorizationColumns
+	authorization, err := scanAuthorization(tx.QueryRowContext(ctx, query, authorizationId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No pending authorization like this!")
+		}
+		return nil, err
+	}
+
+	var holdId sql.NullInt64
+	if err := tx.QueryRowContext(ctx, `SELECT hold_id FROM "card_authorization" WHERE id = $1`, authorizationId).Scan(&holdId); err != nil {
+		return nil, err
+	}
+
+	if holdId.Valid {
+		if err := settleHold(ctx, tx, holdId.Int64, types.HoldStatusReleased); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return authorization, nil
+}
+
+func scanAuthorization(row interface{ Scan(...any) error }) (*types.CardAuthorization, error) {
+	authorization := &types.CardAuthorization{}
+
+	if err := row.Scan(
+		&authorization.Id,
+		&authorization.CardId,
+		&authorization.Amount,
+		&authorization.CapturedAmount,
+		&authorization.MerchantName,
+		&authorization.MerchantId,
+		&authorization.MerchantCategory,
+		&authorization.Status,
+		&authorization.CreatedAt,
+		&authorization.UpdatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	return authorization, nil
+}
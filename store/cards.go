@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// cardValidYears is how long a newly issued card stays valid.
+const cardValidYears = 3
+
+const cardColumns = `c.id, c.serial_no, c.expiry_date, c.status, c.created_at, c.terminated_at`
+
+type CardStore struct {
+	db     *sql.DB
+	cipher *FieldCipher
+}
+
+// IssueCard creates a virtual card on the user's account. An account can only
+// hold one card that has not been terminated.
+func (s *CardStore) IssueCard(ctx context.Context, userId int64) (*types.IssuedCard, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	accounts, err := lockAccounts(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	accountId := accounts[userId].id
+
+	var liveCards int
+	query := `SELECT COUNT(*) FROM "card" WHERE account_id = $1 AND status != 'terminated'`
+	if err := tx.QueryRowContext(ctx, query, accountId).Scan(&liveCards); err != nil {
+		return nil, err
+	}
+
+	if liveCards > 0 {
+		return nil, fmt.Errorf("You already have a card, terminate it before issuing a new one")
+	}
+
+	cvc, err := utils.RandomDigits(3)
+	if err != nil {
+		return nil, err
+	}
+
+	cvcHash, err := bcrypt.GenerateFromPassword([]byte(cvc), 10)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	expiry := time.Date(now.Year()+cardValidYears, now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	var cardId int64
+	var number string
+	for attempt := 0; attempt < 3 && cardId == 0; attempt++ {
+		number, err = utils.GenerateCardNumber()
+		if err != nil {
+			return nil, err
+		}
+
+		encryptedNumber, err := s.cipher.Encrypt(fieldCardSerialNo, number)
+		if err != nil {
+			return nil, err
+		}
+
+		query := `INSERT INTO "card" (serial_no, serial_no_index, cvc_hash, expiry_date, account_id) VALUES ($1, $2, $3, $4, $5) ON CONFLICT (serial_no_index) DO NOTHING RETURNING id`
+		err = tx.QueryRowContext(ctx, query, encryptedNumber, s.cipher.BlindIndex(fieldCardSerialNo, number), string(cvcHash), expiry, accountId).Scan(&cardId)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	if cardId == 0 {
+		return nil, fmt.Errorf("Could not allocate a card number, try again")
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "account" SET card_id = $1 WHERE id = $2`, cardId, accountId); err != nil {
+		return nil, err
+	}
+
+	card, err := s.scanCard(tx.QueryRowContext(ctx, `SELECT `+cardColumns+` FROM "card" AS c WHERE c.id = $1`, cardId))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return &types.IssuedCard{Card: *card, Number: number, Cvc: cvc}, nil
+}
+
+func (s *CardStore) GetCards(ctx context.Context, userId int64) ([]types.Card, error) {
+	cards := []types.Card{}
+	query := `SELECT ` + cardColumns + ` FROM "card" AS c JOIN "account" AS a ON a.id = c.account_id WHERE a.user_id = $1 ORDER BY c.created_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		card, err := s.scanCard(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		cards = append(cards, *card)
+	}
+
+	return cards, rows.Err()
+}
+
+// SetCardFrozen freezes or unfreezes one of the user's cards. Terminated cards
+// stay terminated.
+func (s *CardStore) SetCardFrozen(ctx context.Context, userId int64, cardId int64, frozen bool) (*types.Card, error) {
+	from, to := types.CardStatusActive, types.CardStatusFrozen
+	if !frozen {
+		from, to = to, from
+	}
+
+	query := `UPDATE "card" AS c SET status = $1 FROM "account" AS a WHERE a.id = c.account_id AND a.user_id = $2 AND c.id = $3 AND c.status IN ($1, $4) RETURNING ` + cardColumns
+	card, err := s.scanCard(s.db.QueryRowContext(ctx, query, to, userId, cardId, from))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No card like this!")
+		}
+		return nil, err
+	}
+
+	return card, nil
+}
+
+func (s *CardStore) TerminateCard(ctx context.Context, userId int64, cardId int64) (*types.Card, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `UPDATE "card" AS c SET status = 'terminated', terminated_at = CURRENT_TIMESTAMP FROM "account" AS a WHERE a.id = c.account_id AND a.user_id = $1 AND c.id = $2 AND c.status != 'terminated' RETURNING ` + cardColumns
+	card, err := s.scanCard(tx.QueryRowContext(ctx, query, userId, cardId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No card like this!")
+		}
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "account" SET card_id = NULL WHERE card_id = $1`, cardId); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return card, nil
+}
+
+func (s *CardStore) scanCard(row interface{ Scan(...any) error }) (*types.Card, error) {
+	card := &types.Card{}
+	var number string
+	var expiry time.Time
+	var terminatedAt sql.NullTime
+
+	if err := row.Scan(
+		&card.Id,
+		s.cipher.Decrypting(fieldCardSerialNo, &number),
+		&expiry,
+		&card.Status,
+		&card.CreatedAt,
+		&terminatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	card.MaskedNumber = utils.MaskCardNumber(number)
+	card.ExpiryMonth = int(expiry.Month())
+	card.ExpiryYear = expiry.Year()
+	if terminatedAt.Valid {
+		card.TerminatedAt = &terminatedAt.Time
+	}
+
+	return card, nil
+}
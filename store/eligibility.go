@@ -0,0 +1,118 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+// LoadCreditPolicy reads the borrowing rules from the environment, falling
+// back to conservative defaults for anything that is unset.
+func LoadCreditPolicy() types.CreditPolicy {
+	return types.CreditPolicy{
+		BaseLimit:         envInt64("CREDIT_BASE_LIMIT", 5000),
+		MonthlyIncrease:   envInt64("CREDIT_MONTHLY_INCREASE", 1000),
+		RepaidLoanBonus:   envInt64("CREDIT_REPAID_LOAN_BONUS", 2500),
+		LateRepaymentCut:  envInt64("CREDIT_LATE_REPAYMENT_CUT", 5000),
+		MaxLimit:          envInt64("CREDIT_MAX_LIMIT", 100000),
+		MinAccountAgeDays: envInt64("CREDIT_MIN_ACCOUNT_AGE_DAYS", 7),
+		MaxActiveLoans:    envInt64("CREDIT_MAX_ACTIVE_LOANS", 2),
+	}
+}
+
+func envInt64(key string, fallback int64) int64 {
+	value, err := strconv.ParseInt(os.Getenv(key), 10, 64)
+	if err != nil || value < 0 {
+		return fallback
+	}
+
+	return value
+}
+
+// borrowingHistory summarises the account age and loans of a user. When it is
+// called inside BorrowMoney the account row is already locked, so two
+// concurrent requests cannot both squeeze under the credit limit.
+func borrowingHistory(ctx context.Context, q interface {
+	QueryRowContext(context.Context, string, ...any) *sql.Row
+}, userId int64) (*types.BorrowingHistory, error) {
+	history := &types.BorrowingHistory{}
+	query := `SELECT
+		COALESCE((SELECT EXTRACT(DAY FROM CURRENT_TIMESTAMP - created_at)::BIGINT FROM "account" WHERE user_id = $1), 0),
+		COUNT(*) FILTER (WHERE status = 'active'),
+		COUNT(*) FILTER (WHERE status = 'active' AND due_at < CURRENT_TIMESTAMP),
+		COALESCE(SUM(principal + interest - amount_repaid) FILTER (WHERE status = 'active'), 0),
+		COUNT(*) FILTER (WHERE status = 'repaid'),
+		COUNT(*) FILTER (WHERE status = 'repaid' AND repaid_at > due_at)
+	FROM "loan" WHERE user_id = $1`
+
+	if err := q.QueryRowContext(ctx, query, userId).Scan(
+		&history.AccountAgeDays,
+		&history.ActiveLoans,
+		&history.OverdueLoans,
+		&history.Outstanding,
+		&history.RepaidLoans,
+		&history.LateRepayments,
+	); err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// evaluateEligibility decides whether a user with the given history may
+// borrow amount. An amount of zero only reports the user's current limit.
+func evaluateEligibility(policy types.CreditPolicy, history types.BorrowingHistory, amount int64) types.Eligibility {
+	limit := policy.BaseLimit +
+		(history.AccountAgeDays/30)*policy.MonthlyIncrease +
+		history.RepaidLoans*policy.RepaidLoanBonus -
+		history.LateRepayments*policy.LateRepaymentCut
+	limit = max(0, min(limit, policy.MaxLimit))
+
+	eligibility := types.Eligibility{
+		Eligible:    true,
+		CreditLimit: limit,
+		Outstanding: history.Outstanding,
+		Available:   max(0, limit-history.Outstanding),
+	}
+
+	reject := func(reason string, message string) types.Eligibility {
+		eligibility.Eligible = false
+		eligibility.Reason = reason
+		eligibility.Message = message
+		return eligibility
+	}
+
+	switch {
+	case amount < 0:
+		return reject(types.ReasonInvalidAmount, "Amount must be greater than zero")
+	case history.AccountAgeDays < policy.MinAccountAgeDays:
+		return reject(types.ReasonAccountTooNew, fmt.Sprintf("Your account must be at least %d days old to borrow", policy.MinAccountAgeDays))
+	case history.OverdueLoans > 0:
+		return reject(types.ReasonLoanOverdue, "You have an overdue loan, repay it before borrowing again")
+	case history.ActiveLoans >= policy.MaxActiveLoans:
+		return reject(types.ReasonTooManyActiveLoans, fmt.Sprintf("You cannot have more than %d active loans", policy.MaxActiveLoans))
+	case eligibility.Available <= 0 || amount > eligibility.Available:
+		return reject(types.ReasonCreditLimitExceeded, fmt.Sprintf("You can borrow at most %d right now", eligibility.Available))
+	}
+
+	return eligibility
+}
+
+// checkEligibility returns a coded error when the user may not borrow amount.
+func checkEligibility(ctx context.Context, tx *sql.Tx, policy types.CreditPolicy, userId int64, amount int64) error {
+	history, err := borrowingHistory(ctx, tx, userId)
+	if err != nil {
+		return err
+	}
+
+	eligibility := evaluateEligibility(policy, *history, amount)
+	if !eligibility.Eligible {
+		return &types.CodedError{Code: eligibility.Reason, Message: eligibility.Message}
+	}
+
+	return nil
+}
@@ -0,0 +1,30 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// EventsChannel is the Postgres channel account events are sent on. Every API
+// instance listens on it and relays the events to its own streams.
+const EventsChannel = "chifunds_events"
+
+type EventStore struct {
+	db *sql.DB
+}
+
+// PublishEvent notifies every listening instance of an event for the user.
+// Event ids come from a sequence so they are the same on every instance and
+// a client can resume from any of them. Postgres caps notifications at 8000
+// bytes, which the event payloads stay well under.
+func (s *EventStore) PublishEvent(ctx context.Context, userId int64, eventType string, data any) error {
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	query := `SELECT pg_notify($1, json_build_object('id', nextval('event_id_seq'), 'type', $2::TEXT, 'user_id', $3::BIGINT, 'data', $4::JSON, 'created_at', CURRENT_TIMESTAMP)::TEXT)`
+	_, err = s.db.ExecContext(ctx, query, EventsChannel, eventType, userId, string(encoded))
+	return err
+}
@@ -0,0 +1,378 @@
+package store
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Columns that are stored encrypted. The name is bound to the ciphertext, so
+// a value copied into another column does not decrypt there.
+const (
+	fieldUserEmail         = "user.email"
+	fieldUserFirstName     = "user.first_name"
+	fieldUserLastName      = "user.last_name"
+	fieldCardSerialNo      = "card.serial_no"
+	fieldLoginAttemptEmail = "login_attempt.email"
+)
+
+const (
+	dataKeyField      = "field"
+	dataKeyBlindIndex = "blind_index"
+)
+
+// ciphertextPrefix marks encrypted values, which read
+// "enc:v1:<data key id>:<base64 nonce and ciphertext>". Values without it
+// were written before encryption and are returned as they are.
+const ciphertextPrefix = "enc:v1:"
+
+const dataKeyLock = "data_key_creation"
+
+// FieldCipher encrypts columns with data keys that are stored wrapped by the
+// KeyProvider's master key. New values use the newest field key; older keys
+// stay readable until Reencrypt has moved every value off them. Equality
+// lookups go through a blind index, an HMAC of the value under a key of its
+// own, as the ciphertexts of one value differ every time.
+type FieldCipher struct {
+	db       *sql.DB
+	provider KeyProvider
+
+	mu       sync.RWMutex
+	active   int64
+	keys     map[int64][]byte
+	indexKey []byte
+}
+
+// NewFieldCipher loads the data keys, creating the first field and blind
+// index keys when there are none yet.
+func NewFieldCipher(ctx context.Context, db *sql.DB, provider KeyProvider) (*FieldCipher, error) {
+	c := &FieldCipher{db: db, provider: provider}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, dataKeyLock); err != nil {
+		return nil, err
+	}
+
+	for _, purpose := range []string{dataKeyField, dataKeyBlindIndex} {
+		var exists bool
+		if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM "data_key" WHERE purpose = $1)`, purpose).Scan(&exists); err != nil {
+			return nil, err
+		}
+
+		if !exists {
+			if err := c.createDataKey(ctx, tx, purpose); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *FieldCipher) createDataKey(ctx context.Context, tx *sql.Tx, purpose string) error {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+
+	wrapped, err := c.provider.WrapKey(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO "data_key" (purpose, master_key_id, wrapped_key) VALUES ($1, $2, $3)`
+	_, err = tx.ExecContext(ctx, query, purpose, c.provider.KeyId(), base64.StdEncoding.EncodeToString(wrapped))
+	return err
+}
+
+// load unwraps every data key. The newest field key is the active one; the
+// blind index key never changes, as every index would have to be rebuilt.
+func (c *FieldCipher) load(ctx context.Context) error {
+	rows, err := c.db.QueryContext(ctx, `SELECT id, purpose, master_key_id, wrapped_key FROM "data_key" ORDER BY id`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var active int64
+	var indexKey []byte
+	keys := make(map[int64][]byte)
+	for rows.Next() {
+		var id int64
+		var purpose, masterKeyId, encoded string
+		if err := rows.Scan(&id, &purpose, &masterKeyId, &encoded); err != nil {
+			return err
+		}
+
+		wrapped, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return fmt.Errorf("data key %d: %v", id, err)
+		}
+
+		key, err := c.provider.UnwrapKey(ctx, masterKeyId, wrapped)
+		if err != nil {
+			return fmt.Errorf("data key %d: %v", id, err)
+		}
+
+		if purpose == dataKeyBlindIndex {
+			if indexKey == nil {
+				indexKey = key
+			}
+			continue
+		}
+
+		keys[id] = key
+		active = id
+	}
+
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if active == 0 || indexKey == nil {
+		return errors.New("the data keys have not been created")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.active = active
+	c.keys = keys
+	c.indexKey = indexKey
+
+	return nil
+}
+
+// key returns the field key with the id, reloading the keys once when it is
+// unknown, as another instance may have rotated them.
+func (c *FieldCipher) key(id int64) ([]byte, error) {
+	c.mu.RLock()
+	key, ok := c.keys[id]
+	c.mu.RUnlock()
+
+	if ok {
+		return key, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if err := c.load(ctx); err != nil {
+		return nil, err
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if key, ok := c.keys[id]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("data key %d does not exist", id)
+}
+
+// Encrypt encrypts the value of a column with the active field key.
+func (c *FieldCipher) Encrypt(field string, value string) (string, error) {
+	c.mu.RLock()
+	id, key := c.active, c.keys[c.active]
+	c.mu.RUnlock()
+
+	gcm, err := newFieldGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), []byte(field))
+	return fmt.Sprintf("%s%d:%s", ciphertextPrefix, id, base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+// Decrypt decrypts the value of a column. Values written before encryption
+// are returned unchanged.
+func (c *FieldCipher) Decrypt(field string, value string) (string, error) {
+	if !strings.HasPrefix(value, ciphertextPrefix) {
+		return value, nil
+	}
+
+	keyId, encoded, found := strings.Cut(strings.TrimPrefix(value, ciphertextPrefix), ":")
+	if !found {
+		return "", fmt.Errorf("malformed %s ciphertext", field)
+	}
+
+	id, err := strconv.ParseInt(keyId, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("malformed %s ciphertext", field)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed %s ciphertext", field)
+	}
+
+	key, err := c.key(id)
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := newFieldGCM(key)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("malformed %s ciphertext", field)
+	}
+
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("could not decrypt %s: %v", field, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// BlindIndex is the value stored next to an encrypted column to look rows up
+// by it.
+func (c *FieldCipher) BlindIndex(field string, value string) string {
+	c.mu.RLock()
+	mac := hmac.New(sha256.New, c.indexKey)
+	c.mu.RUnlock()
+
+	mac.Write([]byte(field))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Decrypting scans an encrypted column into dest, decrypting it on the way.
+func (c *FieldCipher) Decrypting(field string, dest *string) sql.Scanner {
+	return &decryptingScanner{cipher: c, field: field, dest: dest}
+}
+
+type decryptingScanner struct {
+	cipher *FieldCipher
+	field  string
+	dest   *string
+}
+
+func (s *decryptingScanner) Scan(src any) error {
+	var value string
+	switch src := src.(type) {
+	case nil:
+		*s.dest = ""
+		return nil
+	case string:
+		value = src
+	case []byte:
+		value = string(src)
+	default:
+		return fmt.Errorf("cannot scan %T into %s", src, s.field)
+	}
+
+	plaintext, err := s.cipher.Decrypt(s.field, value)
+	if err != nil {
+		return err
+	}
+
+	*s.dest = plaintext
+	return nil
+}
+
+// RotateDataKey adds a new field key, which encrypts every value written from
+// now on. Reencrypt moves the existing values onto it.
+func (c *FieldCipher) RotateDataKey(ctx context.Context) error {
+	tx, err := c.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := c.createDataKey(ctx, tx, dataKeyField); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	return c.load(ctx)
+}
+
+// RewrapDataKeys wraps the data keys still wrapped by an older master key
+// with the current one, after which the older master key can be retired.
+func (c *FieldCipher) RewrapDataKeys(ctx context.Context) (int, error) {
+	rows, err := c.db.QueryContext(ctx, `SELECT id, master_key_id, wrapped_key FROM "data_key" WHERE master_key_id != $1`, c.provider.KeyId())
+	if err != nil {
+		return 0, err
+	}
+
+	type dataKey struct {
+		id          int64
+		masterKeyId string
+		wrapped     string
+	}
+	var stale []dataKey
+	for rows.Next() {
+		var key dataKey
+		if err := rows.Scan(&key.id, &key.masterKeyId, &key.wrapped); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range stale {
+		wrapped, err := base64.StdEncoding.DecodeString(key.wrapped)
+		if err != nil {
+			return 0, fmt.Errorf("data key %d: %v", key.id, err)
+		}
+
+		plain, err := c.provider.UnwrapKey(ctx, key.masterKeyId, wrapped)
+		if err != nil {
+			return 0, fmt.Errorf("data key %d: %v", key.id, err)
+		}
+
+		rewrapped, err := c.provider.WrapKey(ctx, plain)
+		if err != nil {
+			return 0, err
+		}
+
+		query := `UPDATE "data_key" SET master_key_id = $1, wrapped_key = $2 WHERE id = $3`
+		if _, err := c.db.ExecContext(ctx, query, c.provider.KeyId(), base64.StdEncoding.EncodeToString(rewrapped), key.id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(stale), nil
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// testFieldCipher returns a cipher with fixed keys, which never has to load
+// them from the database.
+func testFieldCipher() *FieldCipher {
+	return &FieldCipher{
+		active: 2,
+		keys: map[int64][]byte{
+			1: bytes.Repeat([]byte{1}, 32),
+			2: bytes.Repeat([]byte{2}, 32),
+		},
+		indexKey: bytes.Repeat([]byte{3}, 32),
+	}
+}
+
+func TestFieldCipherRoundTrip(t *testing.T) {
+	c := testFieldCipher()
+
+	tests := []struct {
+		field string
+		value string
+	}{
+		{field: fieldUserEmail, value: "ada@example.com"},
+		{field: fieldUserFirstName, value: "Adaeze"},
+		{field: fieldUserLastName, value: "Ọkafọr"},
+		{field: fieldCardSerialNo, value: "5120000000000005"},
+		{field: fieldLoginAttemptEmail, value: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.field, func(t *testing.T) {
+			encrypted, err := c.Encrypt(test.field, test.value)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if !strings.HasPrefix(encrypted, ciphertextPrefix+"2:") {
+				t.Fatalf("Encrypt = %q, want it under the active key", encrypted)
+			}
+			if test.value != "" && strings.Contains(encrypted, test.value) {
+				t.Fatalf("Encrypt = %q contains the plaintext", encrypted)
+			}
+
+			again, err := c.Encrypt(test.field, test.value)
+			if err != nil {
+				t.Fatalf("Encrypt: %v", err)
+			}
+			if again == encrypted {
+				t.Fatal("encrypting the same value twice gave the same ciphertext")
+			}
+
+			decrypted, err := c.Decrypt(test.field, encrypted)
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if decrypted != test.value {
+				t.Fatalf("Decrypt = %q, want %q", decrypted, test.value)
+			}
+		})
+	}
+}
+
+func TestFieldCipherDecrypt(t *testing.T) {
+	c := testFieldCipher()
+
+	email, err := c.Encrypt(fieldUserEmail, "ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A value written under the older key stays readable after rotation.
+	c.active = 1
+	older, err := c.Encrypt(fieldUserEmail, "ada@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.active = 2
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(email, ciphertextPrefix+"2:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed[len(sealed)-1] ^= 1
+	tampered := ciphertextPrefix + "2:" + base64.StdEncoding.EncodeToString(sealed)
+
+	tests := []struct {
+		name  string
+		field string
+		value string
+		want  string
+		ok    bool
+	}{
+		{name: "plaintext from before encryption", field: fieldUserEmail, value: "ada@example.com", want: "ada@example.com", ok: true},
+		{name: "older key", field: fieldUserEmail, value: older, want: "ada@example.com", ok: true},
+		{name: "copied into another field", field: fieldUserFirstName, value: email},
+		{name: "copied into another table", field: fieldLoginAttemptEmail, value: email},
+		{name: "tampered ciphertext", field: fieldUserEmail, value: tampered},
+		{name: "key id swapped", field: fieldUserEmail, value: strings.Replace(email, ciphertextPrefix+"2:", ciphertextPrefix+"1:", 1)},
+		{name: "missing key id", field: fieldUserEmail, value: ciphertextPrefix + "AAAA"},
+		{name: "key id not a number", field: fieldUserEmail, value: ciphertextPrefix + "x:AAAA"},
+		{name: "not base64", field: fieldUserEmail, value: ciphertextPrefix + "2:not base64!"},
+		{name: "shorter than a nonce", field: fieldUserEmail, value: ciphertextPrefix + "2:AAAA"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			decrypted, err := c.Decrypt(test.field, test.value)
+			if !test.ok {
+				if err == nil {
+					t.Fatalf("Decrypt = %q, want an error", decrypted)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Decrypt: %v", err)
+			}
+			if decrypted != test.want {
+				t.Fatalf("Decrypt = %q, want %q", decrypted, test.want)
+			}
+		})
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	c := testFieldCipher()
+	index := c.BlindIndex(fieldUserEmail, "ada@example.com")
+
+	if len(index) != 64 {
+		t.Fatalf("BlindIndex = %q, want 64 hex characters", index)
+	}
+
+	tests := []struct {
+		name   string
+		cipher *FieldCipher
+		field  string
+		value  string
+		same   bool
+	}{
+		{name: "same value", cipher: c, field: fieldUserEmail, value: "ada@example.com", same: true},
+		{name: "another cipher with the same key", cipher: testFieldCipher(), field: fieldUserEmail, value: "ada@example.com", same: true},
+		{name: "after rotating the field key", cipher: &FieldCipher{active: 3, keys: map[int64][]byte{3: bytes.Repeat([]byte{4}, 32)}, indexKey: c.indexKey}, field: fieldUserEmail, value: "ada@example.com", same: true},
+		{name: "other value", cipher: c, field: fieldUserEmail, value: "ada@example.org"},
+		{name: "other case", cipher: c, field: fieldUserEmail, value: "Ada@example.com"},
+		{name: "other field", cipher: c, field: fieldLoginAttemptEmail, value: "ada@example.com"},
+		{name: "other index key", cipher: &FieldCipher{indexKey: bytes.Repeat([]byte{5}, 32)}, field: fieldUserEmail, value: "ada@example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.cipher.BlindIndex(test.field, test.value); (got == index) != test.same {
+				t.Fatalf("BlindIndex = %q, same as %q: %v, want %v", got, index, got == index, test.same)
+			}
+		})
+	}
+}
+
+func TestDecryptingScanner(t *testing.T) {
+	c := testFieldCipher()
+
+	encrypted, err := c.Encrypt(fieldUserFirstName, "Adaeze")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		src  any
+		want string
+		ok   bool
+	}{
+		{name: "string", src: encrypted, want: "Adaeze", ok: true},
+		{name: "bytes", src: []byte(encrypted), want: "Adaeze", ok: true},
+		{name: "null", src: nil, want: "", ok: true},
+		{name: "plaintext", src: "Adaeze", want: "Adaeze", ok: true},
+		{name: "number", src: int64(1)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dest := "unchanged"
+			err := c.Decrypting(fieldUserFirstName, &dest).Scan(test.src)
+			if !test.ok {
+				if err == nil {
+					t.Fatal("Scan succeeded, want an error")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Scan: %v", err)
+			}
+			if dest != test.want {
+				t.Fatalf("Scan = %q, want %q", dest, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+// activeHold matches holds that still reserve money. A hold stops counting
+// once it is settled or its expiry has passed.
+const activeHold = `status = 'active' AND (expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP)`
+
+const holdColumns = `id, amount, kind, COALESCE(reference, ''), CASE WHEN status = 'active' AND expires_at <= CURRENT_TIMESTAMP THEN 'released' ELSE status END, expires_at, created_at`
+
+type HoldStore struct {
+	db *sql.DB
+}
+
+// PlaceHold reserves amount on the user's account for a pending operation.
+// A ttl of zero keeps the hold until it is released or consumed.
+func (s *HoldStore) PlaceHold(ctx context.Context, userId int64, amount int64, kind string, reference string, ttl time.Duration) (*types.Hold, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	accounts, err := lockAccounts(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	account := accounts[userId]
+
+	available, err := availableBalance(ctx, tx, account)
+	if err != nil {
+		return nil, err
+	}
+
+	if amount > available {
+		return nil, fmt.Errorf("Insufficient funds")
+	}
+
+	holdId, err := placeHold(ctx, tx, account.id, amount, kind, reference, ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	hold, err := scanHold(tx.QueryRowContext(ctx, `SELECT `+holdColumns+` FROM "hold" WHERE id = $1`, holdId))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return hold, nil
+}
+
+func (s *HoldStore) ReleaseHold(ctx context.Context, userId int64, holdId int64) error {
+	query := `UPDATE "hold" AS h SET status = 'released', settled_at = CURRENT_TIMESTAMP FROM "account" AS a WHERE a.id = h.account_id AND a.user_id = $1 AND h.id = $2 AND h.status = 'active'`
+	result, err := s.db.ExecContext(ctx, query, userId, holdId)
+	if err != nil {
+		return err
+	}
+
+	if released, err := result.RowsAffected(); err != nil {
+		return err
+	} else if released == 0 {
+		return fmt.Errorf("No active hold like this!")
+	}
+
+	return nil
+}
+
+// GetActiveHolds lists the holds currently reserving money on the user's account.
+func (s *HoldStore) GetActiveHolds(ctx context.Context, userId int64) ([]types.Hold, error) {
+	holds := []types.Hold{}
+	query := `SELECT ` + holdColumns + ` FROM "hold" WHERE account_id = (SELECT id FROM "account" WHERE user_id = $1) AND ` + activeHold + ` ORDER BY created_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		hold, err := scanHold(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		holds = append(holds, *hold)
+	}
+
+	return holds, rows.Err()
+}
+
+// availableBalance is the cached ledger balance of a locked account minus
+// everything its active holds reserve.
+func availableBalance(ctx context.Context, tx *sql.Tx, account lockedAccount) (int64, error) {
+	var held int64
+	query := `SELECT COALESCE(SUM(amount), 0) FROM "hold" WHERE account_id = $1 AND ` + activeHold
+	if err := tx.QueryRowContext(ctx, query, account.id).Scan(&held); err != nil {
+		return 0, err
+	}
+
+	return int64(account.money) - held, nil
+}
+
+// placeHold inserts a hold without checking the balance; callers must have
+// locked the account and checked availableBalance first.
+func placeHold(ctx context.Context, tx *sql.Tx, accountId int64, amount int64, kind string, reference string, ttl time.Duration) (int64, error) {
+	var expiresAt any
+	if ttl > 0 {
+		expiresAt = ttl.Seconds()
+	}
+
+	var holdId int64
+	query := `INSERT INTO "hold" (account_id, amount, kind, reference, expires_at) VALUES ($1, $2, $3, NULLIF($4, ''), CURRENT_TIMESTAMP + make_interval(secs => $5)) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, accountId, amount, kind, reference, expiresAt).Scan(&holdId); err != nil {
+		return 0, err
+	}
+
+	return holdId, nil
+}
+
+// settleHold marks a hold released or consumed. Settling a hold that is no
+// longer active is a no-op.
+func settleHold(ctx context.Context, tx *sql.Tx, holdId int64, status string) error {
+	query := `UPDATE "hold" SET status = $1, settled_at = CURRENT_TIMESTAMP WHERE id = $2 AND status = 'active'`
+	_, err := tx.ExecContext(ctx, query, status, holdId)
+	return err
+}
+
+func scanHold(row interface{ Scan(...any) error }) (*types.Hold, error) {
+	hold := &types.Hold{}
+	var expiresAt sql.NullTime
+
+	if err := row.Scan(
+		&hold.Id,
+		&hold.Amount,
+		&hold.Kind,
+		&hold.Reference,
+		&hold.Status,
+		&expiresAt,
+		&hold.CreatedAt,
+	); err != nil {
+		return nil, err
+	}
+
+	if expiresAt.Valid {
+		hold.ExpiresAt = &expiresAt.Time
+	}
+
+	return hold, nil
+}
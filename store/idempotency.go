@@ -0,0 +1,81 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+type IdempotencyStore struct {
+	db *sql.DB
+}
+
+// ReserveIdempotencyKey claims a key for the user. It returns nil when the key
+// was free and is now reserved for this request, or the record left behind by
+// the earlier request that used the same key. Keys expire after 24 hours.
+func (s *IdempotencyStore) ReserveIdempotencyKey(ctx context.Context, userId int64, key string, requestHash string) (*types.IdempotencyRecord, error) {
+	expiredQuery := `DELETE FROM "idempotency_key" WHERE user_id = $1 AND key = $2 AND created_at < CURRENT_TIMESTAMP - INTERVAL '24 hours'`
+	if _, err := s.db.ExecContext(ctx, expiredQuery, userId, key); err != nil {
+		return nil, err
+	}
+
+	reserveQuery := `INSERT INTO "idempotency_key" (user_id, key, request_hash) VALUES ($1, $2, $3) ON CONFLICT (user_id, key) DO NOTHING`
+	result, err := s.db.ExecContext(ctx, reserveQuery, userId, key, requestHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if reserved, err := result.RowsAffected(); err != nil {
+		return nil, err
+	} else if reserved == 1 {
+		return nil, nil
+	}
+
+	var statusCode sql.NullInt64
+	var headers, response sql.NullString
+	record := &types.IdempotencyRecord{Key: key}
+	query := `SELECT request_hash, status_code, response_headers, response FROM "idempotency_key" WHERE user_id = $1 AND key = $2`
+	if err := s.db.QueryRowContext(ctx, query, userId, key).Scan(
+		&record.RequestHash,
+		&statusCode,
+		&headers,
+		&response,
+	); err != nil {
+		return nil, err
+	}
+
+	record.Completed = statusCode.Valid
+	record.StatusCode = int(statusCode.Int64)
+	record.Response = []byte(response.String)
+
+	if headers.Valid {
+		if err := json.Unmarshal([]byte(headers.String), &record.Headers); err != nil {
+			return nil, err
+		}
+	}
+
+	return record, nil
+}
+
+// CompleteIdempotencyKey stores the response to replay for the key, with the
+// headers it needs to be read the same way.
+func (s *IdempotencyStore) CompleteIdempotencyKey(ctx context.Context, userId int64, key string, statusCode int, headers map[string]string, response []byte) error {
+	encodedHeaders, err := json.Marshal(headers)
+	if err != nil {
+		return err
+	}
+
+	query := `UPDATE "idempotency_key" SET status_code = $1, response_headers = $2, response = $3 WHERE user_id = $4 AND key = $5`
+	_, err = s.db.ExecContext(ctx, query, statusCode, string(encodedHeaders), string(response), userId, key)
+	return err
+}
+
+// ReleaseIdempotencyKey frees a reserved key so the client can retry a request
+// that failed on our side.
+func (s *IdempotencyStore) ReleaseIdempotencyKey(ctx context.Context, userId int64, key string) error {
+	query := `DELETE FROM "idempotency_key" WHERE user_id = $1 AND key = $2 AND status_code IS NULL`
+	_, err := s.db.ExecContext(ctx, query, userId, key)
+	return err
+}
@@ -0,0 +1,173 @@
+package store
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps data keys with a master key that never leaves
+// it, the way a KMS does. Data keys record the id of the master key that
+// wrapped them, so a provider can keep unwrapping with older master keys
+// after the current one is replaced.
+type KeyProvider interface {
+	KeyId() string
+	WrapKey(ctx context.Context, dataKey []byte) ([]byte, error)
+	UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error)
+}
+
+// NewKeyProvider picks the key provider from KEY_PROVIDER. Only "local", the
+// default, is available for now.
+func NewKeyProvider() (KeyProvider, error) {
+	switch provider := os.Getenv("KEY_PROVIDER"); provider {
+	case "", "local":
+		path := masterKeyFile()
+
+		var previous []string
+		if files := os.Getenv("MASTER_KEY_PREVIOUS_FILES"); files != "" {
+			previous = strings.Split(files, ",")
+		}
+
+		return NewLocalKeyProvider(path, previous...)
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", provider)
+	}
+}
+
+// InitMasterKey creates the master key file named by MASTER_KEY_FILE for the
+// local key provider. It refuses to replace an existing file, as every value
+// encrypted under the key in it would be lost. It returns the file's path.
+func InitMasterKey() (string, error) {
+	path := masterKeyFile()
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+
+	if _, err := file.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		file.Close()
+		return "", err
+	}
+
+	return path, file.Close()
+}
+
+func masterKeyFile() string {
+	if path := os.Getenv("MASTER_KEY_FILE"); path != "" {
+		return path
+	}
+
+	return "master.key"
+}
+
+// LocalKeyProvider keeps its master keys in files. The current key must
+// exist, InitMasterKey creates it once for the whole deployment; previous
+// keys only unwrap, until RewrapDataKeys has moved every data key to the
+// current one.
+type LocalKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewLocalKeyProvider(path string, previous ...string) (*LocalKeyProvider, error) {
+	key, err := readMasterKey(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("master key %s does not exist, copy the deployment's key there or create the first one with reencrypt -init", path)
+	} else if err != nil {
+		return nil, err
+	}
+
+	provider := &LocalKeyProvider{current: masterKeyId(key), keys: make(map[string][]byte)}
+	provider.keys[provider.current] = key
+
+	for _, path := range previous {
+		key, err := readMasterKey(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		provider.keys[masterKeyId(key)] = key
+	}
+
+	return provider, nil
+}
+
+func (p *LocalKeyProvider) KeyId() string {
+	return p.current
+}
+
+func (p *LocalKeyProvider) WrapKey(ctx context.Context, dataKey []byte) ([]byte, error) {
+	gcm, err := newFieldGCM(p.keys[p.current])
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return gcm.Seal(nonce, nonce, dataKey, []byte(p.current)), nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(ctx context.Context, keyId string, wrapped []byte) ([]byte, error) {
+	key, ok := p.keys[keyId]
+	if !ok {
+		return nil, fmt.Errorf("master key %s is not available", keyId)
+	}
+
+	gcm, err := newFieldGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("wrapped key is too short")
+	}
+
+	nonce, sealed := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, []byte(keyId))
+}
+
+// readMasterKey reads a base64 encoded 256 bit key.
+func readMasterKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("%s does not hold a base64 encoded 256 bit key", path)
+	}
+
+	return key, nil
+}
+
+// masterKeyId names a master key without giving anything away about it.
+func masterKeyId(key []byte) string {
+	sum := sha256.Sum256(key)
+	return "local/" + hex.EncodeToString(sum[:8])
+}
+
+func newFieldGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
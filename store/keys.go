@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+// keyRotationLock is the advisory lock held while a key is rotated, so only
+// one instance rotates when several notice the key is due at once.
+const keyRotationLock = "encryption_key_rotation"
+
+// KeyStore keeps the private keys wrapped by the KeyProvider's master key,
+// the same way the data keys are.
+type KeyStore struct {
+	db       *sql.DB
+	provider KeyProvider
+}
+
+// GetEncryptionKeys returns the keys that are still accepted, newest first.
+// The first one is the current key unless a rotation is under way.
+func (s *KeyStore) GetEncryptionKeys(ctx context.Context) ([]types.EncryptionKey, error) {
+	query := `SELECT kid, private_key, master_key_id, created_at, retires_at FROM "encryption_key" WHERE retires_at IS NULL OR retires_at > CURRENT_TIMESTAMP ORDER BY created_at DESC`
+	rows, err := s.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var keys []types.EncryptionKey
+	for rows.Next() {
+		var key types.EncryptionKey
+		var masterKeyId sql.NullString
+		if err := rows.Scan(&key.Kid, &key.PrivateKey, &masterKeyId, &key.CreatedAt, &key.RetiresAt); err != nil {
+			return nil, err
+		}
+
+		if key.PrivateKey, err = s.unwrap(ctx, masterKeyId, key.PrivateKey); err != nil {
+			return nil, fmt.Errorf("encryption key %s: %v", key.Kid, err)
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, rows.Err()
+}
+
+// ImportRetiringKey stores a key that is only accepted for overlap, without
+// it ever becoming the current key. Importing a key twice keeps the first.
+func (s *KeyStore) ImportRetiringKey(ctx context.Context, key types.EncryptionKey, overlap time.Duration) error {
+	wrapped, err := s.wrap(ctx, key.PrivateKey)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO "encryption_key" (kid, private_key, master_key_id, retires_at) VALUES ($1, $2, $3, CURRENT_TIMESTAMP + make_interval(secs => $4)) ON CONFLICT (kid) DO NOTHING`
+	_, err = s.db.ExecContext(ctx, query, key.Kid, wrapped, s.provider.KeyId(), overlap.Seconds())
+	return err
+}
+
+// RotateEncryptionKey makes key the current key when the current one is older
+// than rotateAfter, or when there is none yet. The replaced key is accepted
+// for overlap longer, and keys past their overlap are deleted. It reports
+// whether the key was stored; false means another instance rotated first.
+func (s *KeyStore) RotateEncryptionKey(ctx context.Context, key types.EncryptionKey, rotateAfter time.Duration, overlap time.Duration) (bool, error) {
+	wrapped, err := s.wrap(ctx, key.PrivateKey)
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, keyRotationLock); err != nil {
+		return false, err
+	}
+
+	var due bool
+	query := `SELECT COALESCE(MAX(created_at) <= CURRENT_TIMESTAMP - make_interval(secs => $1), TRUE) FROM "encryption_key" WHERE retires_at IS NULL`
+	if err := tx.QueryRowContext(ctx, query, rotateAfter.Seconds()).Scan(&due); err != nil {
+		return false, err
+	}
+
+	if !due {
+		return false, nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "encryption_key" SET retires_at = CURRENT_TIMESTAMP + make_interval(secs => $1) WHERE retires_at IS NULL`, overlap.Seconds()); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "encryption_key" WHERE retires_at <= CURRENT_TIMESTAMP`); err != nil {
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `INSERT INTO "encryption_key" (kid, private_key, master_key_id) VALUES ($1, $2, $3)`, key.Kid, wrapped, s.provider.KeyId()); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// WrapEncryptionKeys wraps the keys still stored in plaintext, or wrapped by
+// an older master key, with the current master key. It returns how many keys
+// it rewrote.
+func (s *KeyStore) WrapEncryptionKeys(ctx context.Context) (int, error) {
+	query := `SELECT kid, private_key, master_key_id FROM "encryption_key" WHERE master_key_id IS NULL OR master_key_id != $1`
+	rows, err := s.db.QueryContext(ctx, query, s.provider.KeyId())
+	if err != nil {
+		return 0, err
+	}
+
+	type storedKey struct {
+		kid         string
+		privateKey  string
+		masterKeyId sql.NullString
+	}
+	var stale []storedKey
+	for rows.Next() {
+		var key storedKey
+		if err := rows.Scan(&key.kid, &key.privateKey, &key.masterKeyId); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		stale = append(stale, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, key := range stale {
+		plain, err := s.unwrap(ctx, key.masterKeyId, key.privateKey)
+		if err != nil {
+			return 0, fmt.Errorf("encryption key %s: %v", key.kid, err)
+		}
+
+		wrapped, err := s.wrap(ctx, plain)
+		if err != nil {
+			return 0, err
+		}
+
+		// Only the value that was read is replaced, so a concurrent wrap of
+		// the same key is not undone.
+		query := `UPDATE "encryption_key" SET private_key = $1, master_key_id = $2 WHERE kid = $3 AND private_key = $4`
+		if _, err := s.db.ExecContext(ctx, query, wrapped, s.provider.KeyId(), key.kid, key.privateKey); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(stale), nil
+}
+
+func (s *KeyStore) wrap(ctx context.Context, privateKey string) (string, error) {
+	wrapped, err := s.provider.WrapKey(ctx, []byte(privateKey))
+	if err != nil {
+		return "", err
+	}
+
+	return base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// unwrap returns the PEM of a stored private key. Keys stored before they
+// were wrapped have no master key id and are returned as they are.
+func (s *KeyStore) unwrap(ctx context.Context, masterKeyId sql.NullString, stored string) (string, error) {
+	if !masterKeyId.Valid {
+		return stored, nil
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil {
+		return "", err
+	}
+
+	privateKey, err := s.provider.UnwrapKey(ctx, masterKeyId.String, wrapped)
+	if err != nil {
+		return "", err
+	}
+
+	return string(privateKey), nil
+}
@@ -0,0 +1,208 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+// System ledger accounts are not backed by a customer "account" row. The
+// lending pool is debited whenever ChiFunds lends money out and the opening
+// balance account absorbs balances that existed before the ledger did.
+const (
+	LendingPoolAccount    = "system:lending_pool"
+	OpeningBalanceAccount = "system:opening_balance"
+)
+
+const (
+	journalKindTransfer         = "transfer"
+	journalKindLoanDisbursement = "loan_disbursement"
+	journalKindOpeningBalance   = "opening_balance"
+)
+
+type LedgerStore struct {
+	db *sql.DB
+}
+
+// RecomputeBalance derives the balance of an account from its postings and
+// rewrites the cached "account".money column if the two have drifted apart.
+func (s *LedgerStore) RecomputeBalance(ctx context.Context, accountId int64) (*types.LedgerBalance, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	balance := &types.LedgerBalance{AccountId: accountId}
+	if err := tx.QueryRowContext(ctx, `SELECT money FROM "account" WHERE id = $1 FOR UPDATE`, accountId).Scan(&balance.Cached); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No account like this!")
+		}
+		return nil, err
+	}
+
+	ledgerAccountId, err := ledgerAccountForAccount(ctx, tx, accountId)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT COALESCE(SUM(CASE WHEN direction = 'credit' THEN amount ELSE -amount END), 0) FROM "posting" WHERE ledger_account_id = $1`
+	if err := tx.QueryRowContext(ctx, query, ledgerAccountId).Scan(&balance.Derived); err != nil {
+		return nil, err
+	}
+
+	if balance.Derived != balance.Cached {
+		if _, err := tx.ExecContext(ctx, `UPDATE "account" SET money = $1 WHERE id = $2`, balance.Derived, accountId); err != nil {
+			return nil, err
+		}
+		balance.Corrected = true
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return balance, nil
+}
+
+// postJournalEntry records a balanced journal entry and applies each posting
+// to the cached balance of the customer account it touches. Credits increase
+// a balance and debits decrease it.
+func postJournalEntry(ctx context.Context, tx *sql.Tx, entry types.JournalEntry) (int64, error) {
+	entryId, err := insertJournalEntry(ctx, tx, entry)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, posting := range entry.Postings {
+		delta := posting.Amount
+		if posting.Direction == types.PostingDebit {
+			delta = -delta
+		}
+
+		query := `UPDATE "account" SET money = money + $1 FROM "ledger_account" AS la WHERE la.id = $2 AND la.account_id = "account".id`
+		if _, err := tx.ExecContext(ctx, query, delta, posting.LedgerAccountId); err != nil {
+			return 0, err
+		}
+	}
+
+	return entryId, nil
+}
+
+// insertJournalEntry writes the entry and its postings without touching any
+// cached balance.
+func insertJournalEntry(ctx context.Context, tx *sql.Tx, entry types.JournalEntry) (int64, error) {
+	if err := validateJournalEntry(entry); err != nil {
+		return 0, err
+	}
+
+	var entryId int64
+	transactionId := sql.NullInt64{Int64: entry.TransactionId, Valid: entry.TransactionId != 0}
+	query := `INSERT INTO "journal_entry" (kind, description, transaction_id) VALUES ($1, $2, $3) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, entry.Kind, entry.Description, transactionId).Scan(&entryId); err != nil {
+		return 0, err
+	}
+
+	for _, posting := range entry.Postings {
+		query := `INSERT INTO "posting" (journal_entry_id, ledger_account_id, direction, amount) VALUES ($1, $2, $3, $4)`
+		if _, err := tx.ExecContext(ctx, query, entryId, posting.LedgerAccountId, posting.Direction, posting.Amount); err != nil {
+			return 0, err
+		}
+	}
+
+	return entryId, nil
+}
+
+func validateJournalEntry(entry types.JournalEntry) error {
+	if len(entry.Postings) < 2 {
+		return fmt.Errorf("A journal entry needs at least two postings")
+	}
+
+	var debits, credits int64
+	for _, posting := range entry.Postings {
+		if posting.Amount <= 0 {
+			return fmt.Errorf("Posting amounts must be greater than zero")
+		}
+
+		switch posting.Direction {
+		case types.PostingDebit:
+			debits += posting.Amount
+		case types.PostingCredit:
+			credits += posting.Amount
+		default:
+			return fmt.Errorf("Unknown posting direction: %s", posting.Direction)
+		}
+	}
+
+	if debits != credits {
+		return fmt.Errorf("Unbalanced journal entry: %d debited, %d credited", debits, credits)
+	}
+
+	return nil
+}
+
+// systemLedgerAccount returns the id of a system ledger account by its code.
+func systemLedgerAccount(ctx context.Context, tx *sql.Tx, code string) (int64, error) {
+	var id int64
+	query := `INSERT INTO "ledger_account" (code) VALUES ($1) ON CONFLICT (code) DO UPDATE SET code = EXCLUDED.code RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, code).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
+
+// ledgerAccountForAccount returns the ledger account behind a customer account,
+// creating it on first use. Accounts that already held money before the
+// ledger existed get an opening balance entry so their postings add up to the
+// cached balance. Callers must hold the row lock on the account.
+func ledgerAccountForAccount(ctx context.Context, tx *sql.Tx, accountId int64) (int64, error) {
+	var id int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM "ledger_account" WHERE account_id = $1`, accountId).Scan(&id)
+	if err == nil {
+		return id, nil
+	} else if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	query := `INSERT INTO "ledger_account" (code, account_id) VALUES ($1, $2) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, fmt.Sprintf("account:%d", accountId), accountId).Scan(&id); err != nil {
+		return 0, err
+	}
+
+	var money int64
+	if err := tx.QueryRowContext(ctx, `SELECT money FROM "account" WHERE id = $1`, accountId).Scan(&money); err != nil {
+		return 0, err
+	}
+
+	if money == 0 {
+		return id, nil
+	}
+
+	openingId, err := systemLedgerAccount(ctx, tx, OpeningBalanceAccount)
+	if err != nil {
+		return 0, err
+	}
+
+	accountSide, openingSide := types.PostingCredit, types.PostingDebit
+	if money < 0 {
+		accountSide, openingSide = openingSide, accountSide
+		money = -money
+	}
+
+	_, err = insertJournalEntry(ctx, tx, types.JournalEntry{
+		Kind:        journalKindOpeningBalance,
+		Description: fmt.Sprintf("Opening balance for account %d", accountId),
+		Postings: []types.Posting{
+			{LedgerAccountId: openingId, Direction: openingSide, Amount: money},
+			{LedgerAccountId: id, Direction: accountSide, Amount: money},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return id, nil
+}
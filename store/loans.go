@@ -0,0 +1,221 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/brownei/chifunds-api/types"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLoanTermDays        = 30
+	defaultLoanInterestRateBps = 500
+)
+
+const journalKindLoanRepayment = "loan_repayment"
+
+// loanColumns is shared by every query that scans a loan with scanLoan. The
+// overdue status is never stored, it is derived from the due date on read.
+const loanColumns = `l.id, l.principal, l.interest_rate_bps, l.interest, l.term_days, COALESCE(l.explanation, ''), l.amount_repaid, l.principal + l.interest - l.amount_repaid, CASE WHEN l.status = 'active' AND l.due_at < CURRENT_TIMESTAMP THEN 'overdue' ELSE l.status END, l.disbursed_at, l.due_at, l.repaid_at`
+
+type LoanStore struct {
+	db     *sql.DB
+	policy types.CreditPolicy
+}
+
+// GetEligibility reports how much the user could borrow right now.
+func (s *LoanStore) GetEligibility(ctx context.Context, userId int64) (*types.Eligibility, error) {
+	history, err := borrowingHistory(ctx, s.db, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	eligibility := evaluateEligibility(s.policy, *history, 0)
+	return &eligibility, nil
+}
+
+func (s *LoanStore) GetLoans(ctx context.Context, userId int64) ([]types.Loan, error) {
+	loans := []types.Loan{}
+	query := `SELECT ` + loanColumns + ` FROM "loan" AS l WHERE l.user_id = $1 ORDER BY l.disbursed_at DESC`
+
+	rows, err := s.db.QueryContext(ctx, query, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		loan, err := scanLoan(rows)
+		if err != nil {
+			return nil, err
+		}
+
+		loans = append(loans, *loan)
+	}
+
+	return loans, rows.Err()
+}
+
+func (s *LoanStore) GetLoan(ctx context.Context, userId int64, loanId int64) (*types.Loan, error) {
+	query := `SELECT ` + loanColumns + ` FROM "loan" AS l WHERE l.id = $1 AND l.user_id = $2`
+
+	loan, err := scanLoan(s.db.QueryRowContext(ctx, query, loanId, userId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No loan like this!")
+		}
+		return nil, err
+	}
+
+	return loan, nil
+}
+
+// RepayLoan moves money from the borrower's account back into the lending
+// pool and marks the loan repaid once nothing is outstanding.
+func (s *LoanStore) RepayLoan(ctx context.Context, logger *zap.SugaredLogger, userId int64, loanId int64, amount int32) (*types.Loan, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("Amount must be greater than zero")
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	accounts, err := lockAccounts(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+	account := accounts[userId]
+
+	var status string
+	var outstanding int64
+	query := `SELECT status, principal + interest - amount_repaid FROM "loan" WHERE id = $1 AND user_id = $2 FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, loanId, userId).Scan(&status, &outstanding); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("No loan like this!")
+		}
+		return nil, err
+	}
+
+	if status == types.LoanStatusRepaid {
+		return nil, fmt.Errorf("This loan has already been repaid")
+	}
+
+	if int64(amount) > outstanding {
+		return nil, fmt.Errorf("Amount is more than the outstanding balance of %d", outstanding)
+	}
+
+	available, err := availableBalance(ctx, tx, account)
+	if err != nil {
+		return nil, err
+	}
+
+	if available < int64(amount) {
+		return nil, fmt.Errorf("Insufficient funds")
+	}
+
+	var transactionId int64
+	query = `INSERT INTO "transactions" (receiver_id, sender_id, amount_sent) VALUES ($1, $2, $3) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, chifundsUserId, userId, amount).Scan(&transactionId); err != nil {
+		return nil, err
+	}
+
+	lendingPool, err := systemLedgerAccount(ctx, tx, LendingPoolAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	borrower, err := ledgerAccountForAccount(ctx, tx, account.id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = postJournalEntry(ctx, tx, types.JournalEntry{
+		Kind:          journalKindLoanRepayment,
+		Description:   fmt.Sprintf("Repayment of loan %d by user %d", loanId, userId),
+		TransactionId: transactionId,
+		Postings: []types.Posting{
+			{LedgerAccountId: borrower, Direction: types.PostingDebit, Amount: int64(amount)},
+			{LedgerAccountId: lendingPool, Direction: types.PostingCredit, Amount: int64(amount)},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	query = `INSERT INTO "loan_repayment" (loan_id, amount, transaction_id) VALUES ($1, $2, $3)`
+	if _, err := tx.ExecContext(ctx, query, loanId, amount, transactionId); err != nil {
+		return nil, err
+	}
+
+	query = `UPDATE "loan" SET amount_repaid = amount_repaid + $1, status = CASE WHEN principal + interest - amount_repaid - $1 <= 0 THEN 'repaid' ELSE status END, repaid_at = CASE WHEN principal + interest - amount_repaid - $1 <= 0 THEN CURRENT_TIMESTAMP ELSE repaid_at END WHERE id = $2`
+	if _, err := tx.ExecContext(ctx, query, amount, loanId); err != nil {
+		return nil, err
+	}
+
+	loan, err := scanLoan(tx.QueryRowContext(ctx, `SELECT `+loanColumns+` FROM "loan" AS l WHERE l.id = $1`, loanId))
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("User %d repaid %d on loan %d", userId, amount, loanId)
+	return loan, nil
+}
+
+// createLoan records the loan behind a disbursement that has just been posted
+// in the same transaction.
+func createLoan(ctx context.Context, tx *sql.Tx, userId int64, accountId int64, transactionId int64, payload types.BorrowMoneyDto) (*types.Loan, error) {
+	termDays := int64(payload.TermDays)
+	if termDays == 0 {
+		termDays = defaultLoanTermDays
+	}
+
+	rateBps := envInt64("LOAN_INTEREST_RATE_BPS", defaultLoanInterestRateBps)
+	principal := int64(payload.Amount)
+	// Interest is a flat rate over the whole term, rounded up to the next unit.
+	interest := (principal*rateBps + 9999) / 10000
+
+	var loanId int64
+	query := `INSERT INTO "loan" (user_id, account_id, transaction_id, principal, interest_rate_bps, interest, term_days, explanation, due_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, CURRENT_TIMESTAMP + make_interval(days => $7)) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, userId, accountId, transactionId, principal, rateBps, interest, termDays, payload.Explanation).Scan(&loanId); err != nil {
+		return nil, err
+	}
+
+	return scanLoan(tx.QueryRowContext(ctx, `SELECT `+loanColumns+` FROM "loan" AS l WHERE l.id = $1`, loanId))
+}
+
+func scanLoan(row interface{ Scan(...any) error }) (*types.Loan, error) {
+	loan := &types.Loan{}
+	var repaidAt sql.NullTime
+
+	if err := row.Scan(
+		&loan.Id,
+		&loan.Principal,
+		&loan.InterestRateBps,
+		&loan.Interest,
+		&loan.TermDays,
+		&loan.Explanation,
+		&loan.AmountRepaid,
+		&loan.Outstanding,
+		&loan.Status,
+		&loan.DisbursedAt,
+		&loan.DueAt,
+		&repaidAt,
+	); err != nil {
+		return nil, err
+	}
+
+	if repaidAt.Valid {
+		loan.RepaidAt = &repaidAt.Time
+	}
+
+	return loan, nil
+}
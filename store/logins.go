@@ -0,0 +1,150 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+// ErrInvalidCredentials is returned for a wrong password. It is the only
+// sign in failure that counts towards a lockout.
+var ErrInvalidCredentials = fmt.Errorf("Invalid email or password")
+
+// LoadLoginPolicy reads the sign in throttling rules from the environment.
+func LoadLoginPolicy() types.LoginPolicy {
+	return types.LoginPolicy{
+		FreeFailures:    envInt64("LOGIN_FREE_FAILURES", 3),
+		MaxDelaySeconds: envInt64("LOGIN_MAX_DELAY_SECONDS", 300),
+		LockoutFailures: envInt64("LOGIN_LOCKOUT_FAILURES", 10),
+		LockoutMinutes:  envInt64("LOGIN_LOCKOUT_MINUTES", 30),
+		IPFailureLimit:  envInt64("LOGIN_IP_FAILURE_LIMIT", 20),
+		IPWindowMinutes: envInt64("LOGIN_IP_WINDOW_MINUTES", 15),
+	}
+}
+
+type LoginAttemptStore struct {
+	db     *sql.DB
+	policy types.LoginPolicy
+	cipher *FieldCipher
+}
+
+// CheckLoginAllowed reports whether the email may try to sign in from the ip
+// right now. A locked account, an account still inside the delay that follows
+// its recent failures, or an ip with too many recent failures has to wait.
+// With no email only the ip is checked.
+func (s *LoginAttemptStore) CheckLoginAllowed(ctx context.Context, email string, ip string) (*types.LoginThrottle, error) {
+	var locked bool
+	var lockedFor, delayedFor float64
+	query := `SELECT COALESCE(locked_until > CURRENT_TIMESTAMP, FALSE), COALESCE(EXTRACT(EPOCH FROM locked_until - CURRENT_TIMESTAMP), 0)::FLOAT, CASE WHEN failed_login_count > $2 THEN COALESCE(EXTRACT(EPOCH FROM last_failed_login_at + make_interval(secs => LEAST(POWER(2, failed_login_count - $2 - 1), $3)) - CURRENT_TIMESTAMP), 0)::FLOAT ELSE 0 END FROM "user" WHERE email_index = $1`
+	err := s.db.QueryRowContext(ctx, query, s.cipher.BlindIndex(fieldUserEmail, email), s.policy.FreeFailures, s.policy.MaxDelaySeconds).Scan(&locked, &lockedFor, &delayedFor)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if locked {
+		return &types.LoginThrottle{Locked: true, RetryAfter: retrySeconds(lockedFor)}, nil
+	}
+
+	var ipFailures int64
+	var ipResetsIn float64
+	query = `SELECT COUNT(*), COALESCE(EXTRACT(EPOCH FROM MIN(created_at) + make_interval(mins => $2) - CURRENT_TIMESTAMP), 0)::FLOAT FROM "login_attempt" WHERE ip = $1 AND NOT succeeded AND created_at > CURRENT_TIMESTAMP - make_interval(mins => $2)`
+	if err := s.db.QueryRowContext(ctx, query, ip, s.policy.IPWindowMinutes).Scan(&ipFailures, &ipResetsIn); err != nil {
+		return nil, err
+	}
+
+	if ipFailures >= s.policy.IPFailureLimit {
+		return &types.LoginThrottle{RetryAfter: retrySeconds(ipResetsIn)}, nil
+	}
+
+	if delayedFor > 0 {
+		return &types.LoginThrottle{RetryAfter: retrySeconds(delayedFor)}, nil
+	}
+
+	return nil, nil
+}
+
+// RecordLoginFailure audits a failed sign in and, when the email belongs to a
+// user, counts it against them. It returns true when this failure locked the
+// account, so the caller can send the unlock email.
+func (s *LoginAttemptStore) RecordLoginFailure(ctx context.Context, attempt types.LoginAttempt) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var userId sql.NullInt64
+	var locked bool
+	query := `UPDATE "user" SET failed_login_count = failed_login_count + 1, last_failed_login_at = CURRENT_TIMESTAMP, locked_until = CASE WHEN failed_login_count + 1 >= $2 THEN CURRENT_TIMESTAMP + make_interval(mins => $3) ELSE locked_until END WHERE email_index = $1 RETURNING id, failed_login_count >= $2`
+	err = tx.QueryRowContext(ctx, query, s.cipher.BlindIndex(fieldUserEmail, attempt.Email), s.policy.LockoutFailures, s.policy.LockoutMinutes).Scan(&userId, &locked)
+	if err != nil && err != sql.ErrNoRows {
+		return false, err
+	}
+
+	if locked {
+		// The failures are counted again from zero once the lock ends.
+		if _, err := tx.ExecContext(ctx, `UPDATE "user" SET failed_login_count = 0 WHERE id = $1`, userId.Int64); err != nil {
+			return false, err
+		}
+	}
+
+	if err := s.insertLoginAttempt(ctx, tx, userId, attempt, false); err != nil {
+		return false, err
+	}
+
+	return locked, tx.Commit()
+}
+
+// RecordLoginSuccess audits a sign in and clears the user's failures.
+func (s *LoginAttemptStore) RecordLoginSuccess(ctx context.Context, userId int64, attempt types.LoginAttempt) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "user" SET failed_login_count = 0 WHERE id = $1`, userId); err != nil {
+		return err
+	}
+
+	if err := s.insertLoginAttempt(ctx, tx, sql.NullInt64{Int64: userId, Valid: true}, attempt, true); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UnlockAccount lifts a lockout early, from the link emailed when it started.
+func (s *LoginAttemptStore) UnlockAccount(ctx context.Context, email string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE "user" SET locked_until = NULL, failed_login_count = 0 WHERE email_index = $1`, s.cipher.BlindIndex(fieldUserEmail, email))
+	if err != nil {
+		return err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return fmt.Errorf("No user like this!")
+	}
+
+	return nil
+}
+
+func (s *LoginAttemptStore) insertLoginAttempt(ctx context.Context, tx *sql.Tx, userId sql.NullInt64, attempt types.LoginAttempt, succeeded bool) error {
+	email, err := s.cipher.Encrypt(fieldLoginAttemptEmail, attempt.Email)
+	if err != nil {
+		return err
+	}
+
+	query := `INSERT INTO "login_attempt" (user_id, email, ip, user_agent, succeeded, reason) VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''))`
+	_, err = tx.ExecContext(ctx, query, userId, email, attempt.IP, attempt.UserAgent, succeeded, attempt.Reason)
+	return err
+}
+
+// retrySeconds rounds a wait up to whole seconds for the Retry-After header.
+func retrySeconds(seconds float64) int {
+	return max(1, int(math.Ceil(seconds)))
+}
@@ -0,0 +1,44 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type NonceStore struct {
+	db *sql.DB
+}
+
+// ClaimNonce records a request nonce for ttl. It reports false when the nonce
+// was already claimed, which means the payload carrying it is a replay.
+func (s *NonceStore) ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	expiredQuery := `DELETE FROM "payload_nonce" WHERE nonce = $1 AND expires_at <= CURRENT_TIMESTAMP`
+	if _, err := s.db.ExecContext(ctx, expiredQuery, nonce); err != nil {
+		return false, err
+	}
+
+	query := `INSERT INTO "payload_nonce" (nonce, expires_at) VALUES ($1, CURRENT_TIMESTAMP + make_interval(secs => $2)) ON CONFLICT (nonce) DO NOTHING`
+	result, err := s.db.ExecContext(ctx, query, nonce, ttl.Seconds())
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return claimed == 1, nil
+}
+
+// PruneNonces deletes the nonces that have expired. Payloads carrying them
+// are already refused as stale.
+func (s *NonceStore) PruneNonces(ctx context.Context) (int64, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM "payload_nonce" WHERE expires_at <= CURRENT_TIMESTAMP`)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
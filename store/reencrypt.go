@@ -0,0 +1,124 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// encryptedColumn is a column kept encrypted, with the column holding its
+// blind index when rows are looked up by it.
+type encryptedColumn struct {
+	table  string
+	column string
+	index  string
+}
+
+var encryptedColumns = []encryptedColumn{
+	{table: "user", column: "email", index: "email_index"},
+	{table: "user", column: "first_name"},
+	{table: "user", column: "last_name"},
+	{table: "card", column: "serial_no", index: "serial_no_index"},
+	{table: "login_attempt", column: "email"},
+}
+
+// reencryptBatch is how many rows Reencrypt updates per query.
+const reencryptBatch = 500
+
+const reencryptLock = "field_reencryption"
+
+// Reencrypt encrypts every value that is still in plaintext or under an older
+// field key with the active key, and fills in missing blind indexes. It only
+// touches rows that need it, so it is cheap to run when there are none. It
+// returns how many values were rewritten.
+func (c *FieldCipher) Reencrypt(ctx context.Context) (int64, error) {
+	conn, err := c.db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	// Only one instance works through the rows, the others wait for it and
+	// then find nothing left to do.
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1))`, reencryptLock); err != nil {
+		return 0, err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock(hashtext($1))`, reencryptLock)
+
+	c.mu.RLock()
+	current := fmt.Sprintf("%s%d:%%", ciphertextPrefix, c.active)
+	c.mu.RUnlock()
+
+	var total int64
+	for _, column := range encryptedColumns {
+		field := column.table + "." + column.column
+		pending := fmt.Sprintf(`%s NOT LIKE $1`, column.column)
+		if column.index != "" {
+			pending = fmt.Sprintf(`(%s OR %s IS NULL)`, pending, column.index)
+		}
+
+		// Rows are walked by id. One that changed between the read and the
+		// update is left as it is and picked up by the next run.
+		var lastId int64
+		for {
+			query := fmt.Sprintf(`SELECT id, %s FROM "%s" WHERE %s AND id > $2 ORDER BY id LIMIT $3`, column.column, column.table, pending)
+			rows, err := conn.QueryContext(ctx, query, current, lastId, reencryptBatch)
+			if err != nil {
+				return total, err
+			}
+
+			type pendingRow struct {
+				id    int64
+				value string
+			}
+			var batch []pendingRow
+			for rows.Next() {
+				var row pendingRow
+				if err := rows.Scan(&row.id, &row.value); err != nil {
+					rows.Close()
+					return total, err
+				}
+				batch = append(batch, row)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return total, err
+			}
+
+			if len(batch) == 0 {
+				break
+			}
+
+			for _, row := range batch {
+				lastId = row.id
+
+				plaintext, err := c.Decrypt(field, row.value)
+				if err != nil {
+					return total, fmt.Errorf("%s of row %d: %v", field, row.id, err)
+				}
+
+				value := row.value
+				if !strings.HasPrefix(row.value, strings.TrimSuffix(current, "%")) {
+					if value, err = c.Encrypt(field, plaintext); err != nil {
+						return total, err
+					}
+				}
+
+				set := fmt.Sprintf(`%s = $1`, column.column)
+				args := []any{value, row.id, row.value}
+				if column.index != "" {
+					set += fmt.Sprintf(`, %s = $4`, column.index)
+					args = append(args, c.BlindIndex(field, plaintext))
+				}
+
+				query := fmt.Sprintf(`UPDATE "%s" SET %s WHERE id = $2 AND %s = $3`, column.table, set, column.column)
+				if _, err := conn.ExecContext(ctx, query, args...); err != nil {
+					return total, fmt.Errorf("%s of row %d: %v", field, row.id, err)
+				}
+				total++
+			}
+		}
+	}
+
+	return total, nil
+}
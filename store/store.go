@@ -4,6 +4,7 @@ import (
 	"context"
 	"database/sql"
 	"log"
+	"time"
 
 	"github.com/brownei/chifunds-api/types"
 	"go.uber.org/zap"
@@ -15,20 +16,103 @@ type Store struct {
 		GetUsersByEmail(ctx context.Context, email string, forLogn bool) (*types.User, error)
 		GetAllUsers() ([]types.User, error)
 		CreateNewUser(ctx context.Context, payload types.RegisterUserPayload) (*types.User, error)
-		CreateChiFundsAdminUser(payload types.RegisterUserPayload) error
+		CreateChiFundsSystemUser(payload types.RegisterUserPayload) error
 		GetBalance(context.Context, string) (*types.Balance, error)
+		GetUserBalance(ctx context.Context, userId int64) (*types.Balance, error)
+		VerifyEmail(ctx context.Context, email string) error
+		SetRole(ctx context.Context, userId int64, role string) error
+		PromoteFirstAdmin(ctx context.Context, email string) (bool, error)
+		ClaimVerificationEmail(ctx context.Context, userId int64, interval time.Duration) (bool, error)
 	}
 
 	Auth interface {
-		Login(ctx context.Context, existingUser *types.User, payload types.LoginPayload) (string, error)
+		Login(ctx context.Context, existingUser *types.User, payload types.LoginPayload) (*types.AuthTokens, *types.SignInChallenge, error)
+		SignIn(ctx context.Context, existingUser *types.User) (*types.AuthTokens, *types.SignInChallenge, error)
+		CompleteTwoFactorSignIn(ctx context.Context, challengeToken string, code string) (*types.AuthTokens, string, error)
+		CreateSession(ctx context.Context, userId int64, email string) (*types.AuthTokens, error)
+		RefreshSession(ctx context.Context, refreshToken string) (*types.AuthTokens, error)
+		Logout(ctx context.Context, sessionId int64) error
+		SessionActive(ctx context.Context, sessionId int64) (bool, error)
+		RevokeUserSessions(ctx context.Context, userId int64) error
+		CreatePasswordReset(ctx context.Context, userId int64) (string, error)
+		ResetPassword(ctx context.Context, token string, password string) error
 	}
 
 	Transactions interface {
-		BorrowMoney(ctx context.Context, logger *zap.SugaredLogger, lendedMoney int32, userId int8) error
-		TransferMoney(context.Context, *zap.SugaredLogger, types.User, int32, string) error
+		BorrowMoney(ctx context.Context, logger *zap.SugaredLogger, userId int64, payload types.BorrowMoneyDto) (*types.Loan, error)
+		TransferMoney(context.Context, *zap.SugaredLogger, types.User, int32, string) (*types.TransferResult, error)
 		GetReceivedTransactions(context.Context, string) ([]types.ReceivedTransactions, error)
 		GetSentTransactions(context.Context, string) ([]types.SentTransactions, error)
-		GetBorrowedTransactions(context.Context) ([]types.BorrowedTransactions, error)
+		GetBorrowedTransactions(context.Context, string) ([]types.BorrowedTransactions, error)
+		GetAllBorrowers(context.Context, types.BorrowerFilter) ([]types.Borrower, error)
+	}
+
+	Loans interface {
+		GetEligibility(ctx context.Context, userId int64) (*types.Eligibility, error)
+		GetLoans(ctx context.Context, userId int64) ([]types.Loan, error)
+		GetLoan(ctx context.Context, userId int64, loanId int64) (*types.Loan, error)
+		RepayLoan(ctx context.Context, logger *zap.SugaredLogger, userId int64, loanId int64, amount int32) (*types.Loan, error)
+	}
+
+	Cards interface {
+		IssueCard(ctx context.Context, userId int64) (*types.IssuedCard, error)
+		GetCards(ctx context.Context, userId int64) ([]types.Card, error)
+		SetCardFrozen(ctx context.Context, userId int64, cardId int64, frozen bool) (*types.Card, error)
+		TerminateCard(ctx context.Context, userId int64, cardId int64) (*types.Card, error)
+	}
+
+	CardAuthorizations interface {
+		AuthorizeCard(ctx context.Context, payload types.CardAuthorizationDto) (*types.CardAuthorization, error)
+		GetAuthorization(ctx context.Context, authorizationId int64) (*types.CardAuthorization, error)
+		CaptureAuthorization(ctx context.Context, logger *zap.SugaredLogger, authorizationId int64, amount int32) (*types.CardAuthorization, error)
+		VoidAuthorization(ctx context.Context, authorizationId int64) (*types.CardAuthorization, error)
+	}
+
+	Holds interface {
+		PlaceHold(ctx context.Context, userId int64, amount int64, kind string, reference string, ttl time.Duration) (*types.Hold, error)
+		ReleaseHold(ctx context.Context, userId int64, holdId int64) error
+		GetActiveHolds(ctx context.Context, userId int64) ([]types.Hold, error)
+	}
+
+	Ledger interface {
+		RecomputeBalance(ctx context.Context, accountId int64) (*types.LedgerBalance, error)
+	}
+
+	Idempotency interface {
+		ReserveIdempotencyKey(ctx context.Context, userId int64, key string, requestHash string) (*types.IdempotencyRecord, error)
+		CompleteIdempotencyKey(ctx context.Context, userId int64, key string, statusCode int, headers map[string]string, response []byte) error
+		ReleaseIdempotencyKey(ctx context.Context, userId int64, key string) error
+	}
+
+	TwoFactor interface {
+		BeginTotpEnrollment(ctx context.Context, userId int64) (string, error)
+		ConfirmTotp(ctx context.Context, userId int64, code string) ([]string, error)
+		DisableTotp(ctx context.Context, userId int64, code string) error
+		VerifySecondFactor(ctx context.Context, userId int64, code string, allowRecovery bool) error
+		TotpEnabled(ctx context.Context, userId int64) (bool, error)
+	}
+
+	LoginAttempts interface {
+		CheckLoginAllowed(ctx context.Context, email string, ip string) (*types.LoginThrottle, error)
+		RecordLoginFailure(ctx context.Context, attempt types.LoginAttempt) (bool, error)
+		RecordLoginSuccess(ctx context.Context, userId int64, attempt types.LoginAttempt) error
+		UnlockAccount(ctx context.Context, email string) error
+	}
+
+	Events interface {
+		PublishEvent(ctx context.Context, userId int64, eventType string, data any) error
+	}
+
+	Keys interface {
+		GetEncryptionKeys(ctx context.Context) ([]types.EncryptionKey, error)
+		ImportRetiringKey(ctx context.Context, key types.EncryptionKey, overlap time.Duration) error
+		RotateEncryptionKey(ctx context.Context, key types.EncryptionKey, rotateAfter time.Duration, overlap time.Duration) (bool, error)
+		WrapEncryptionKeys(ctx context.Context) (int, error)
+	}
+
+	Nonces interface {
+		ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+		PruneNonces(ctx context.Context) (int64, error)
 	}
 }
 
@@ -36,28 +120,46 @@ var (
 	users []types.User
 )
 
-func NewStore(db *sql.DB) Store {
+// ChifundsSystemEmail is the email of the ChiFunds system user created on
+// boot. The system user cannot sign in.
+const ChifundsSystemEmail = "chifundsadmin@gmail.com"
+
+// NewStore wires the stores. The cipher encrypts the columns that hold
+// personal and card data.
+func NewStore(db *sql.DB, cipher *FieldCipher) Store {
+	policy := LoadCreditPolicy()
+
 	return Store{
-		Users:        &UserStore{db},
-		Auth:         &AuthStore{db},
-		Transactions: &TransactionStore{db},
+		Users:              &UserStore{db, cipher},
+		Auth:               &AuthStore{db, cipher},
+		Transactions:       &TransactionStore{db, policy, cipher},
+		Loans:              &LoanStore{db, policy},
+		Cards:              &CardStore{db, cipher},
+		Holds:              &HoldStore{db},
+		Ledger:             &LedgerStore{db},
+		Idempotency:        &IdempotencyStore{db},
+		CardAuthorizations: &CardAuthorizationStore{db, cipher},
+		TwoFactor:          &TwoFactorStore{db},
+		LoginAttempts:      &LoginAttemptStore{db, LoadLoginPolicy(), cipher},
+		Events:             &EventStore{db},
+		Keys:               &KeyStore{db, cipher.provider},
+		Nonces:             &NonceStore{db},
 	}
 }
 
 func (s *Store) CreateChiFundsUser() error {
 	payload := types.RegisterUserPayload{
-		Email:          "chifundsadmin@gmail.com",
+		Email:          ChifundsSystemEmail,
 		FirstName:      "ChiFunds",
 		LastName:       "Funding",
 		ProfilePicture: "",
-		Password:       "sfhkbhagassvnldfhdgklhdhguytigndnb",
 		EmailVerified:  true,
 	}
 
 	_, err := s.Users.GetChifundsUser(payload.Email, false)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			if err := s.Users.CreateChiFundsAdminUser(payload); err != nil {
+			if err := s.Users.CreateChiFundsSystemUser(payload); err != nil {
 				if err == sql.ErrNoRows {
 					return nil
 				}
@@ -65,11 +167,11 @@ func (s *Store) CreateChiFundsUser() error {
 				return err
 			}
 
-			log.Printf("Admin user created!")
+			log.Printf("System user created!")
 			return nil
 
 		} else {
-			log.Printf("Admin user already available")
+			log.Printf("System user already available")
 			return nil
 		}
 	}
@@ -4,96 +4,210 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
 
 	"github.com/brownei/chifunds-api/types"
-	"github.com/brownei/chifunds-api/types/worker"
+	"github.com/brownei/chifunds-api/utils"
 	"go.uber.org/zap"
 )
 
 type TransactionStore struct {
-	store *sql.DB
+	store  *sql.DB
+	policy types.CreditPolicy
+	cipher *FieldCipher
 }
 
-func (s *TransactionStore) BorrowMoney(ctx context.Context, logger *zap.SugaredLogger, lendedMoney int32, userId int8) error {
-	transactionWorker := worker.NewWorker(ctx, logger)
+// chifundsUserId is the ChiFunds admin user recorded as the sender of every
+// loan disbursement in the "transactions" table.
+const chifundsUserId = 1
 
-	jobs := []types.TransferJob{
-		{
-			Id:           1,
-			Query:        `UPDATE "account" SET money = money + $1 WHERE user_id = $2 RETURNING id`,
-			ExecuteQuery: s.ExecuteQuery,
-			Args:         []interface{}{lendedMoney, userId},
-		},
-		{
-			Id:           1,
-			Query:        `INSERT INTO "transactions" (receiver_id, sender_id, amount_sent) VALUES ($1, $2, $3) RETURNING id`,
-			ExecuteQuery: s.ExecuteQuery,
-			Args:         []interface{}{userId, 1, lendedMoney},
+func (s *TransactionStore) BorrowMoney(ctx context.Context, logger *zap.SugaredLogger, userId int64, payload types.BorrowMoneyDto) (*types.Loan, error) {
+	lendedMoney := payload.Amount
+	if lendedMoney <= 0 {
+		return nil, &types.CodedError{Code: types.ReasonInvalidAmount, Message: "Amount must be greater than zero"}
+	}
+
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	accounts, err := lockAccounts(ctx, tx, userId)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := checkEligibility(ctx, tx, s.policy, userId, int64(lendedMoney)); err != nil {
+		return nil, err
+	}
+
+	var transactionId int64
+	query := `INSERT INTO "transactions" (receiver_id, sender_id, amount_sent) VALUES ($1, $2, $3) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, userId, chifundsUserId, lendedMoney).Scan(&transactionId); err != nil {
+		return nil, err
+	}
+
+	lendingPool, err := systemLedgerAccount(ctx, tx, LendingPoolAccount)
+	if err != nil {
+		return nil, err
+	}
+
+	borrower, err := ledgerAccountForAccount(ctx, tx, accounts[userId].id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = postJournalEntry(ctx, tx, types.JournalEntry{
+		Kind:          journalKindLoanDisbursement,
+		Description:   fmt.Sprintf("Loan disbursement to user %d", userId),
+		TransactionId: transactionId,
+		Postings: []types.Posting{
+			{LedgerAccountId: lendingPool, Direction: types.PostingDebit, Amount: int64(lendedMoney)},
+			{LedgerAccountId: borrower, Direction: types.PostingCredit, Amount: int64(lendedMoney)},
 		},
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	transactionWorker.RunQueriesWithWorkerPool(jobs, len(jobs))
+	loan, err := createLoan(ctx, tx, userId, accounts[userId].id, transactionId, payload)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Lent %d to user %d as loan %d", lendedMoney, userId, loan.Id)
+	return loan, nil
 }
 
-func (s *TransactionStore) TransferMoney(ctx context.Context, logger *zap.SugaredLogger, existingUser types.User, amount int32, accountNumber string) error {
-	transactionWorker := worker.NewWorker(ctx, logger)
+func (s *TransactionStore) TransferMoney(ctx context.Context, logger *zap.SugaredLogger, existingUser types.User, amount int32, accountNumber string) (*types.TransferResult, error) {
+	if amount <= 0 {
+		return nil, fmt.Errorf("Amount must be greater than zero")
+	}
+
 	receivingUser, err := s.GetAccountFromAccountNumber(ctx, accountNumber)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	if receivingUser == nil {
-		return fmt.Errorf("No user with this account number")
+		return nil, fmt.Errorf("No user with this account number")
 	}
 
-	if existingUser.Balance < amount {
-		return fmt.Errorf("Insufficient funds")
+	if receivingUser.ID == existingUser.ID {
+		return nil, fmt.Errorf("You cannot transfer money to yourself")
 	}
 
-	jobs := []types.TransferJob{
-		{
-			Id:           1,
-			Query:        `UPDATE "account" SET money = money - $1 WHERE user_id = $2 RETURNING id`,
-			ExecuteQuery: s.ExecuteQuery,
-			Args:         []interface{}{amount, existingUser.ID},
-		},
-		{
-			Id:           2,
-			Query:        `UPDATE "account" SET money = money + $1 WHERE user_id = $2 RETURNING id`,
-			ExecuteQuery: s.ExecuteQuery,
-			Args:         []interface{}{amount, receivingUser.ID},
-		},
-		{
-			Id:           3,
-			Query:        `INSERT INTO "transactions" (receiver_id, sender_id, amount_sent) VALUES ($1, $2, $3) RETURNING id`,
-			ExecuteQuery: s.ExecuteQuery,
-			Args:         []interface{}{receivingUser.ID, existingUser.ID, amount},
+	tx, err := s.store.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	accounts, err := lockAccounts(ctx, tx, existingUser.ID, receivingUser.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	sender, receiver := accounts[existingUser.ID], accounts[receivingUser.ID]
+	available, err := availableBalance(ctx, tx, sender)
+	if err != nil {
+		return nil, err
+	}
+
+	if available < int64(amount) {
+		return nil, fmt.Errorf("Insufficient funds")
+	}
+
+	var transactionId int64
+	query := `INSERT INTO "transactions" (receiver_id, sender_id, amount_sent) VALUES ($1, $2, $3) RETURNING id`
+	if err := tx.QueryRowContext(ctx, query, receivingUser.ID, existingUser.ID, amount).Scan(&transactionId); err != nil {
+		return nil, err
+	}
+
+	senderLedger, err := ledgerAccountForAccount(ctx, tx, sender.id)
+	if err != nil {
+		return nil, err
+	}
+
+	receiverLedger, err := ledgerAccountForAccount(ctx, tx, receiver.id)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = postJournalEntry(ctx, tx, types.JournalEntry{
+		Kind:          journalKindTransfer,
+		Description:   fmt.Sprintf("Transfer from user %d to user %d", existingUser.ID, receivingUser.ID),
+		TransactionId: transactionId,
+		Postings: []types.Posting{
+			{LedgerAccountId: senderLedger, Direction: types.PostingDebit, Amount: int64(amount)},
+			{LedgerAccountId: receiverLedger, Direction: types.PostingCredit, Amount: int64(amount)},
 		},
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	transactionWorker.RunQueriesWithWorkerPool(jobs, len(jobs))
-	return nil
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	logger.Infof("Transferred %d from user %d to user %d", amount, existingUser.ID, receivingUser.ID)
+	return &types.TransferResult{
+		TransactionId:  transactionId,
+		Amount:         amount,
+		SenderId:       existingUser.ID,
+		ReceiverId:     receivingUser.ID,
+		NameOfReceiver: fmt.Sprintf("%s %s", receivingUser.FirstName, receivingUser.LastName),
+	}, nil
 }
 
-func (s *TransactionStore) ExecuteQuery(ctx context.Context, query string, args []interface{}) error {
-	var datapayload types.DataPayloadFromTransferDto
-	if err := s.store.QueryRowContext(ctx, query, args...).Scan(&datapayload.Id); err != nil {
-		return err
+type lockedAccount struct {
+	id    int64
+	money int32
+}
+
+// lockAccounts takes a row lock on the account of every given user and returns
+// them keyed by user id. Rows are always locked in ascending user id order so
+// two transfers between the same pair of users cannot deadlock each other.
+func lockAccounts(ctx context.Context, tx *sql.Tx, userIds ...int64) (map[int64]lockedAccount, error) {
+	sorted := append([]int64(nil), userIds...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	accounts := make(map[int64]lockedAccount, len(sorted))
+	for _, userId := range sorted {
+		if _, ok := accounts[userId]; ok {
+			continue
+		}
+
+		var account lockedAccount
+		if err := tx.QueryRowContext(ctx, `SELECT id, money FROM "account" WHERE user_id = $1 FOR UPDATE`, userId).Scan(&account.id, &account.money); err != nil {
+			if err == sql.ErrNoRows {
+				return nil, fmt.Errorf("No account for this user!")
+			}
+			return nil, err
+		}
+
+		accounts[userId] = account
 	}
 
-	return nil
+	return accounts, nil
 }
 
 func (s *TransactionStore) GetAccountFromAccountNumber(ctx context.Context, accountNumber string) (*types.User, error) {
 	user := &types.User{}
-	query := `SELECT u.id, u.first_name, u.last_name, u.profile_picture, a.account_number FROM "user" AS u JOIN "account" AS a ON u.id = a.user_id WHERE a.account_number = $1`
+	// A number without a valid check digit only finds an account that had it
+	// before check digits were introduced.
+	query := `SELECT u.id, u.first_name, u.last_name, u.profile_picture, a.account_number FROM "user" AS u JOIN "account" AS a ON u.id = a.user_id WHERE a.account_number = $1 AND ($2 OR a.legacy_number)`
 
-	if err := s.store.QueryRowContext(ctx, query, accountNumber).Scan(
+	if err := s.store.QueryRowContext(ctx, query, accountNumber, utils.ValidAccountNumber(accountNumber)).Scan(
 		&user.ID,
-		&user.FirstName,
-		&user.LastName,
+		s.cipher.Decrypting(fieldUserFirstName, &user.FirstName),
+		s.cipher.Decrypting(fieldUserLastName, &user.LastName),
 		&user.ProfilePicture,
 		&user.AccountNumber,
 	); err != nil {
@@ -108,9 +222,9 @@ func (s *TransactionStore) GetAccountFromAccountNumber(ctx context.Context, acco
 
 func (s *TransactionStore) GetReceivedTransactions(ctx context.Context, email string) ([]types.ReceivedTransactions, error) {
 	var allTransactions []types.ReceivedTransactions
-	query := `SELECT t.amount_sent, t.sent_at, r.first_name, r.last_name FROM "user" AS r JOIN "transactions" AS t ON t.receiver_id = r.id WHERE r.email = $1 AND t.sender_id != 1`
+	query := `SELECT t.amount_sent, t.sent_at, r.first_name, r.last_name FROM "user" AS r JOIN "transactions" AS t ON t.receiver_id = r.id WHERE r.email_index = $1 AND t.sender_id != 1`
 
-	rows, err := s.store.Query(query, email)
+	rows, err := s.store.Query(query, s.cipher.BlindIndex(fieldUserEmail, email))
 	if err != nil {
 		return nil, err
 	}
@@ -120,8 +234,8 @@ func (s *TransactionStore) GetReceivedTransactions(ctx context.Context, email st
 		if err := rows.Scan(
 			&transactions.Amount,
 			&transactions.SentAt,
-			&transactions.SenderFirstName,
-			&transactions.SenderLastName,
+			s.cipher.Decrypting(fieldUserFirstName, &transactions.SenderFirstName),
+			s.cipher.Decrypting(fieldUserLastName, &transactions.SenderLastName),
 		); err != nil {
 			return nil, err
 		}
@@ -134,9 +248,9 @@ func (s *TransactionStore) GetReceivedTransactions(ctx context.Context, email st
 
 func (s *TransactionStore) GetSentTransactions(ctx context.Context, email string) ([]types.SentTransactions, error) {
 	var allTransactions []types.SentTransactions
-	query := `SELECT t.amount_sent, t.sent_at, r.first_name, r.last_name FROM "user" AS r JOIN "transactions" AS t ON t.sender_id = r.id WHERE email = $1`
+	query := `SELECT t.amount_sent, t.sent_at, r.first_name, r.last_name FROM "user" AS r JOIN "transactions" AS t ON t.sender_id = r.id WHERE email_index = $1`
 
-	rows, err := s.store.Query(query, email)
+	rows, err := s.store.Query(query, s.cipher.BlindIndex(fieldUserEmail, email))
 	if err != nil {
 		return nil, err
 	}
@@ -146,8 +260,8 @@ func (s *TransactionStore) GetSentTransactions(ctx context.Context, email string
 		if err := rows.Scan(
 			&transactions.Amount,
 			&transactions.SentAt,
-			&transactions.ReceiverFirstName,
-			&transactions.ReceiverLastName,
+			s.cipher.Decrypting(fieldUserFirstName, &transactions.ReceiverFirstName),
+			s.cipher.Decrypting(fieldUserLastName, &transactions.ReceiverLastName),
 		); err != nil {
 			return nil, err
 		}
@@ -157,25 +271,89 @@ func (s *TransactionStore) GetSentTransactions(ctx context.Context, email string
 	return allTransactions, nil
 }
 
-func (s *TransactionStore) GetBorrowedTransactions(ctx context.Context) ([]types.BorrowedTransactions, error) {
-	var allTransactions []types.BorrowedTransactions
-	query := `SELECT t.amount_sent, t.sent_at FROM "user" AS r JOIN "transactions" AS t ON t.receiver_id = r.id WHERE t.sender_id = $1`
+// borrowedColumns selects a loan disbursement together with the repayment
+// state of its loan. Disbursements made before loans were tracked have no
+// loan row and are reported as untracked.
+const (
+	borrowedStatus  = `CASE WHEN l.id IS NULL THEN 'untracked' WHEN l.status = 'active' AND l.due_at < CURRENT_TIMESTAMP THEN 'overdue' ELSE l.status END`
+	borrowedColumns = `t.amount_sent, t.sent_at, l.id, COALESCE(l.amount_repaid, 0), COALESCE(l.principal + l.interest - l.amount_repaid, 0), ` + borrowedStatus + `, l.due_at`
+)
 
-	rows, err := s.store.Query(query, 1)
+func (s *TransactionStore) GetBorrowedTransactions(ctx context.Context, email string) ([]types.BorrowedTransactions, error) {
+	allTransactions := []types.BorrowedTransactions{}
+	query := `SELECT ` + borrowedColumns + ` FROM "transactions" AS t JOIN "user" AS r ON t.receiver_id = r.id LEFT JOIN "loan" AS l ON l.transaction_id = t.id WHERE t.sender_id = $1 AND r.email_index = $2 ORDER BY t.sent_at DESC`
+
+	rows, err := s.store.QueryContext(ctx, query, chifundsUserId, s.cipher.BlindIndex(fieldUserEmail, email))
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		var transactions types.BorrowedTransactions
-		if err := rows.Scan(
-			&transactions.Amount,
-			&transactions.SentAt,
-		); err != nil {
+		if err := scanBorrowed(rows, &transactions); err != nil {
 			return nil, err
 		}
 
 		allTransactions = append(allTransactions, transactions)
 	}
-	return allTransactions, nil
+	return allTransactions, rows.Err()
+}
+
+// GetAllBorrowers lists the loan disbursements of every user, optionally
+// narrowed down to a date range and a loan status.
+func (s *TransactionStore) GetAllBorrowers(ctx context.Context, filter types.BorrowerFilter) ([]types.Borrower, error) {
+	borrowers := []types.Borrower{}
+	query := `SELECT ` + borrowedColumns + `, r.id, r.email, r.first_name, r.last_name FROM "transactions" AS t JOIN "user" AS r ON t.receiver_id = r.id LEFT JOIN "loan" AS l ON l.transaction_id = t.id WHERE t.sender_id = $1 AND ($2::TIMESTAMP IS NULL OR t.sent_at >= $2) AND ($3::TIMESTAMP IS NULL OR t.sent_at < $3) AND ($4 = '' OR ` + borrowedStatus + ` = $4) ORDER BY t.sent_at DESC`
+
+	var from, to sql.NullTime
+	if filter.From != nil {
+		from = sql.NullTime{Time: *filter.From, Valid: true}
+	}
+	if filter.To != nil {
+		to = sql.NullTime{Time: *filter.To, Valid: true}
+	}
+
+	rows, err := s.store.QueryContext(ctx, query, chifundsUserId, from, to, filter.Status)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var borrower types.Borrower
+		if err := scanBorrowed(rows, &borrower.BorrowedTransactions, &borrower.UserId, s.cipher.Decrypting(fieldUserEmail, &borrower.Email), s.cipher.Decrypting(fieldUserFirstName, &borrower.FirstName), s.cipher.Decrypting(fieldUserLastName, &borrower.LastName)); err != nil {
+			return nil, err
+		}
+
+		borrowers = append(borrowers, borrower)
+	}
+	return borrowers, rows.Err()
+}
+
+func scanBorrowed(rows *sql.Rows, transactions *types.BorrowedTransactions, extra ...any) error {
+	var loanId sql.NullInt64
+	var dueAt sql.NullTime
+
+	dest := append([]any{
+		&transactions.Amount,
+		&transactions.SentAt,
+		&loanId,
+		&transactions.AmountRepaid,
+		&transactions.Outstanding,
+		&transactions.Status,
+		&dueAt,
+	}, extra...)
+	if err := rows.Scan(dest...); err != nil {
+		return err
+	}
+
+	if loanId.Valid {
+		transactions.LoanId = &loanId.Int64
+	}
+	if dueAt.Valid {
+		transactions.DueAt = &dueAt.Time
+	}
+
+	return nil
 }
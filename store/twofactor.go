@@ -0,0 +1,190 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+	"github.com/brownei/chifunds-api/utils"
+)
+
+// recoveryCodeCount is how many recovery codes a user gets when they turn on
+// two-factor authentication.
+const recoveryCodeCount = 10
+
+var errInvalidSecondFactor = &types.CodedError{Code: types.ErrorInvalidTwoFactorCode, Message: "Invalid two-factor code"}
+
+type TwoFactorStore struct {
+	db *sql.DB
+}
+
+// BeginTotpEnrollment stores a new secret for the user. It only takes effect
+// once ConfirmTotp proves the user's app generates codes from it.
+func (s *TwoFactorStore) BeginTotpEnrollment(ctx context.Context, userId int64) (string, error) {
+	secret, err := utils.NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	result, err := s.db.ExecContext(ctx, `UPDATE "user" SET totp_secret = $1, totp_last_counter = NULL WHERE id = $2 AND NOT totp_enabled`, secret, userId)
+	if err != nil {
+		return "", err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return "", err
+	} else if updated == 0 {
+		return "", fmt.Errorf("Two-factor authentication is already enabled")
+	}
+
+	return secret, nil
+}
+
+// ConfirmTotp turns on two-factor authentication with a code from the pending
+// secret and returns the user's recovery codes. They are only stored hashed,
+// so this is the one time they can be shown.
+func (s *TwoFactorStore) ConfirmTotp(ctx context.Context, userId int64, code string) ([]string, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	if err := tx.QueryRowContext(ctx, `SELECT totp_secret, totp_enabled FROM "user" WHERE id = $1 FOR UPDATE`, userId).Scan(&secret, &enabled); err != nil {
+		return nil, err
+	}
+
+	if enabled {
+		return nil, fmt.Errorf("Two-factor authentication is already enabled")
+	} else if !secret.Valid {
+		return nil, fmt.Errorf("Start the two-factor enrollment first")
+	}
+
+	counter, ok := utils.ValidTOTP(secret.String, code, time.Now())
+	if !ok {
+		return nil, errInvalidSecondFactor
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "user" SET totp_enabled = TRUE, totp_last_counter = $1 WHERE id = $2`, counter, userId); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "recovery_code" WHERE user_id = $1`, userId); err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		if codes[i], err = utils.NewRecoveryCode(); err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(ctx, `INSERT INTO "recovery_code" (user_id, code_hash) VALUES ($1, $2)`, userId, utils.HashToken(codes[i])); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// DisableTotp turns two-factor authentication off after checking a code.
+func (s *TwoFactorStore) DisableTotp(ctx context.Context, userId int64, code string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := verifySecondFactor(ctx, tx, userId, code, true); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "user" SET totp_enabled = FALSE, totp_secret = NULL, totp_last_counter = NULL WHERE id = $1`, userId); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "recovery_code" WHERE user_id = $1`, userId); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// VerifySecondFactor checks a code from the user's authenticator, or, when
+// allowRecovery is set, one of their unused recovery codes. Each code is
+// accepted only once.
+func (s *TwoFactorStore) VerifySecondFactor(ctx context.Context, userId int64, code string, allowRecovery bool) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := verifySecondFactor(ctx, tx, userId, code, allowRecovery); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *TwoFactorStore) TotpEnabled(ctx context.Context, userId int64) (bool, error) {
+	var enabled bool
+	if err := s.db.QueryRowContext(ctx, `SELECT totp_enabled FROM "user" WHERE id = $1`, userId).Scan(&enabled); err != nil {
+		return false, err
+	}
+
+	return enabled, nil
+}
+
+// verifySecondFactor locks the user while checking the code so two requests
+// cannot both spend it.
+func verifySecondFactor(ctx context.Context, tx *sql.Tx, userId int64, code string, allowRecovery bool) error {
+	var secret sql.NullString
+	var lastCounter sql.NullInt64
+	var enabled bool
+	query := `SELECT totp_secret, totp_last_counter, totp_enabled FROM "user" WHERE id = $1 FOR UPDATE`
+	if err := tx.QueryRowContext(ctx, query, userId).Scan(&secret, &lastCounter, &enabled); err != nil {
+		return err
+	}
+
+	if !enabled || !secret.Valid {
+		return fmt.Errorf("Two-factor authentication is not enabled")
+	}
+
+	// Codes from periods at or before the last accepted one were either used
+	// already or are older than it, so they are refused.
+	if counter, ok := utils.ValidTOTP(secret.String, code, time.Now()); ok {
+		if lastCounter.Valid && counter <= lastCounter.Int64 {
+			return errInvalidSecondFactor
+		}
+
+		_, err := tx.ExecContext(ctx, `UPDATE "user" SET totp_last_counter = $1 WHERE id = $2`, counter, userId)
+		return err
+	}
+
+	if !allowRecovery {
+		return errInvalidSecondFactor
+	}
+
+	query = `UPDATE "recovery_code" SET used_at = CURRENT_TIMESTAMP WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`
+	result, err := tx.ExecContext(ctx, query, userId, utils.HashToken(utils.NormalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+
+	if used, err := result.RowsAffected(); err != nil {
+		return err
+	} else if used == 0 {
+		return errInvalidSecondFactor
+	}
+
+	return nil
+}
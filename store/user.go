@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/brownei/chifunds-api/types"
 	"github.com/brownei/chifunds-api/utils"
@@ -12,14 +13,15 @@ import (
 )
 
 type UserStore struct {
-	db *sql.DB
+	db     *sql.DB
+	cipher *FieldCipher
 }
 
 func (s *UserStore) GetChifundsUser(email string, forLogin bool) (*types.User, error) {
-	query := `SELECT id FROM "user" WHERE email = $1`
+	query := `SELECT id FROM "user" WHERE email_index = $1`
 	u := &types.User{}
 
-	err := s.db.QueryRow(query, email).Scan(
+	err := s.db.QueryRow(query, s.cipher.BlindIndex(fieldUserEmail, email)).Scan(
 		&u.ID,
 	)
 	if err != nil {
@@ -33,21 +35,23 @@ func (s *UserStore) GetUsersByEmail(ctx context.Context, email string, forLogin
 	var query string
 	//wg := sync.WaitGroup{}
 	if forLogin == true {
-		query = `SELECT u.id, u.email, u.first_name, u.last_name, u.profile_picture, u.email_verified, u.password, a.account_number, a.money FROM "user" AS u JOIN "account" AS a ON u.id = a.user_id WHERE u.email = $1`
+		query = `SELECT u.id, u.email, u.first_name, u.last_name, u.profile_picture, u.email_verified, u.role, u.password, a.account_number, a.money FROM "user" AS u JOIN "account" AS a ON u.id = a.user_id WHERE u.email_index = $1`
 	} else {
-		query = `SELECT u.id, u.email, u.first_name, u.last_name, u.profile_picture, u.email_verified, a.account_number, a.money FROM "user" AS u JOIN "account" AS a ON u.id = a.user_id WHERE u.email = $1`
+		query = `SELECT u.id, u.email, u.first_name, u.last_name, u.profile_picture, u.email_verified, u.role, a.account_number, a.money FROM "user" AS u JOIN "account" AS a ON u.id = a.user_id WHERE u.email_index = $1`
 	}
 
 	u := &types.User{}
+	emailIndex := s.cipher.BlindIndex(fieldUserEmail, email)
 
 	if forLogin == true {
-		err := s.db.QueryRowContext(ctx, query, email).Scan(
+		err := s.db.QueryRowContext(ctx, query, emailIndex).Scan(
 			&u.ID,
-			&u.Email,
-			&u.FirstName,
-			&u.LastName,
+			s.cipher.Decrypting(fieldUserEmail, &u.Email),
+			s.cipher.Decrypting(fieldUserFirstName, &u.FirstName),
+			s.cipher.Decrypting(fieldUserLastName, &u.LastName),
 			&u.ProfilePicture,
 			&u.EmailVerified,
+			&u.Role,
 			&u.Password,
 			&u.AccountNumber,
 			&u.Balance,
@@ -63,13 +67,14 @@ func (s *UserStore) GetUsersByEmail(ctx context.Context, email string, forLogin
 		return u, nil
 
 	} else {
-		err := s.db.QueryRowContext(ctx, query, email).Scan(
+		err := s.db.QueryRowContext(ctx, query, emailIndex).Scan(
 			&u.ID,
-			&u.Email,
-			&u.FirstName,
-			&u.LastName,
+			s.cipher.Decrypting(fieldUserEmail, &u.Email),
+			s.cipher.Decrypting(fieldUserFirstName, &u.FirstName),
+			s.cipher.Decrypting(fieldUserLastName, &u.LastName),
 			&u.ProfilePicture,
 			&u.EmailVerified,
+			&u.Role,
 			&u.AccountNumber,
 			&u.Balance,
 		)
@@ -84,7 +89,7 @@ func (s *UserStore) GetUsersByEmail(ctx context.Context, email string, forLogin
 
 func (s *UserStore) GetAllUsers() ([]types.User, error) {
 	var u []types.User
-	query := "SELECT id, email, first_name, last_name, profile_picture, email_verified FROM \"user\" "
+	query := "SELECT id, email, first_name, last_name, profile_picture, email_verified, role FROM \"user\" "
 
 	rows, err := s.db.Query(query)
 	if err != nil {
@@ -95,11 +100,12 @@ func (s *UserStore) GetAllUsers() ([]types.User, error) {
 		var user types.User
 		err := rows.Scan(
 			&user.ID,
-			&user.Email,
-			&user.FirstName,
-			&user.LastName,
+			s.cipher.Decrypting(fieldUserEmail, &user.Email),
+			s.cipher.Decrypting(fieldUserFirstName, &user.FirstName),
+			s.cipher.Decrypting(fieldUserLastName, &user.LastName),
 			&user.ProfilePicture,
 			&user.EmailVerified,
+			&user.Role,
 		)
 		if err != nil {
 			return nil, err
@@ -111,65 +117,251 @@ func (s *UserStore) GetAllUsers() ([]types.User, error) {
 	return u, nil
 }
 
-func (s *UserStore) CreateChiFundsAdminUser(payload types.RegisterUserPayload) error {
-	hashPassword, err := bcrypt.GenerateFromPassword([]byte(payload.Password), 10)
+// CreateChiFundsSystemUser creates the ChiFunds user recorded as the sender
+// of loan disbursements. It is not a login: it has no account, and its
+// password is no bcrypt hash, so no password matches it.
+func (s *UserStore) CreateChiFundsSystemUser(payload types.RegisterUserPayload) error {
+	email, firstName, lastName, err := s.encryptUser(payload)
 	if err != nil {
-		log.Printf("Couldn't hash a password: %s", err)
 		return err
 	}
 
-	creatingNewUserQuery := `INSERT INTO "user" (email, first_name, last_name, profile_picture, password, email_verified) VALUES ($1, $2, $3, $4, $5, $6)`
+	creatingNewUserQuery := `INSERT INTO "user" (email, email_index, first_name, last_name, profile_picture, password, email_verified) VALUES ($1, $2, $3, $4, $5, '!', $6)`
 
-	_, err = s.db.Query(creatingNewUserQuery, payload.Email, payload.FirstName, payload.LastName, payload.ProfilePicture, hashPassword, payload.EmailVerified)
+	_, err = s.db.Exec(creatingNewUserQuery, email, s.cipher.BlindIndex(fieldUserEmail, payload.Email), firstName, lastName, payload.ProfilePicture, payload.EmailVerified)
 
 	return err
 }
 
+// accountNumberAttempts bounds how many fresh account numbers CreateNewUser
+// tries before giving up on a run of collisions.
+const accountNumberAttempts = 5
+
 func (s *UserStore) CreateNewUser(ctx context.Context, payload types.RegisterUserPayload) (*types.User, error) {
 	user := &types.User{}
-	accountNumber := utils.RandomAccountNumber()
-	log.Printf("account: %s", accountNumber)
 	hashPassword, err := bcrypt.GenerateFromPassword([]byte(payload.Password), 10)
 	if err != nil {
 		log.Printf("Couldn't hash a password: %s", err)
 		return nil, err
 	}
 
-	existingAccountNumberQuery := `SELECT id FROM "account" WHERE account_number = $1`
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
-	err = s.db.QueryRowContext(ctx, existingAccountNumberQuery, accountNumber).Scan()
-	if err == nil {
-		return nil, fmt.Errorf("Account number unavaialble")
+	email, firstName, lastName, err := s.encryptUser(payload)
+	if err != nil {
+		return nil, err
 	}
 
-	creatingNewUserQuery := `INSERT INTO "user" (email, first_name, last_name, profile_picture, password, email_verified) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id, email, first_name, last_name, profile_picture, email_verified`
+	creatingNewUserQuery := `INSERT INTO "user" (email, email_index, first_name, last_name, profile_picture, password, email_verified) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id, email, first_name, last_name, profile_picture, email_verified`
 
-	err = s.db.QueryRowContext(ctx, creatingNewUserQuery, payload.Email, payload.FirstName, payload.LastName, payload.ProfilePicture, hashPassword, payload.EmailVerified).Scan(
+	err = tx.QueryRowContext(ctx, creatingNewUserQuery, email, s.cipher.BlindIndex(fieldUserEmail, payload.Email), firstName, lastName, payload.ProfilePicture, hashPassword, payload.EmailVerified).Scan(
 		&user.ID,
-		&user.Email,
-		&user.FirstName,
-		&user.LastName,
+		s.cipher.Decrypting(fieldUserEmail, &user.Email),
+		s.cipher.Decrypting(fieldUserFirstName, &user.FirstName),
+		s.cipher.Decrypting(fieldUserLastName, &user.LastName),
 		&user.ProfilePicture,
 		&user.EmailVerified,
 	)
+	if err != nil {
+		return nil, err
+	}
 
-	creatingNewAccountQuery := `INSERT INTO "account" (account_number, user_id) VALUES ($1, $2) RETURNING account_number`
-	err = s.db.QueryRowContext(ctx, creatingNewAccountQuery, accountNumber, user.ID).Scan(
-		&user.AccountNumber,
-	)
-	//_, err = scanRowsToReturnUser(rows)
-	return user, err
+	creatingNewAccountQuery := `INSERT INTO "account" (account_number, user_id) VALUES ($1, $2) ON CONFLICT (account_number) DO NOTHING RETURNING account_number`
+	for attempt := 0; attempt < accountNumberAttempts && user.AccountNumber == ""; attempt++ {
+		accountNumber, err := utils.NewAccountNumber()
+		if err != nil {
+			return nil, err
+		}
+
+		err = tx.QueryRowContext(ctx, creatingNewAccountQuery, accountNumber, user.ID).Scan(
+			&user.AccountNumber,
+		)
+		if err != nil && err != sql.ErrNoRows {
+			return nil, err
+		}
+	}
+
+	if user.AccountNumber == "" {
+		return nil, fmt.Errorf("Account number unavaialble")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return user, nil
 }
 
+// encryptUser encrypts the personal details of a new user.
+func (s *UserStore) encryptUser(payload types.RegisterUserPayload) (string, string, string, error) {
+	email, err := s.cipher.Encrypt(fieldUserEmail, payload.Email)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	firstName, err := s.cipher.Encrypt(fieldUserFirstName, payload.FirstName)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	lastName, err := s.cipher.Encrypt(fieldUserLastName, payload.LastName)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	return email, firstName, lastName, nil
+}
+
+// SetRole changes the user's role. Their sessions are revoked when it
+// changes, so no token carrying the old role keeps working, and they sign in
+// again with the new one.
+func (s *UserStore) SetRole(ctx context.Context, userId int64, role string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var current string
+	if err := tx.QueryRowContext(ctx, `SELECT role FROM "user" WHERE id = $1 FOR UPDATE`, userId).Scan(&current); err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("No user like this!")
+		}
+		return err
+	}
+
+	if current == role {
+		return nil
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "user" SET role = $1 WHERE id = $2`, role, userId); err != nil {
+		return err
+	}
+
+	if err := revokeUserSessions(ctx, tx, userId, revokedRoleChange); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PromoteFirstAdmin makes the verified user with this email an admin, unless
+// there is an admin already. It reports whether the user was promoted.
+func (s *UserStore) PromoteFirstAdmin(ctx context.Context, email string) (bool, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	if err := tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM "user" WHERE role = $1)`, types.RoleAdmin).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	var userId int64
+	query := `SELECT id FROM "user" WHERE email_index = $1 AND email_verified AND id <> $2`
+	if err := tx.QueryRowContext(ctx, query, s.cipher.BlindIndex(fieldUserEmail, email), chifundsUserId).Scan(&userId); err != nil {
+		if err == sql.ErrNoRows {
+			return false, fmt.Errorf("No verified user with this email!")
+		}
+		return false, err
+	}
+
+	if _, err := tx.ExecContext(ctx, `UPDATE "user" SET role = $1 WHERE id = $2`, types.RoleAdmin, userId); err != nil {
+		return false, err
+	}
+
+	if err := revokeUserSessions(ctx, tx, userId, revokedRoleChange); err != nil {
+		return false, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// updatePassword replaces the user's password with the hash of password.
+func updatePassword(ctx context.Context, tx *sql.Tx, userId int64, password string) error {
+	hashPassword, err := bcrypt.GenerateFromPassword([]byte(password), 10)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `UPDATE "user" SET password = $1 WHERE id = $2`, hashPassword, userId)
+	return err
+}
+
+// VerifyEmail marks the user's email as verified.
+func (s *UserStore) VerifyEmail(ctx context.Context, email string) error {
+	result, err := s.db.ExecContext(ctx, `UPDATE "user" SET email_verified = TRUE WHERE email_index = $1`, s.cipher.BlindIndex(fieldUserEmail, email))
+	if err != nil {
+		return err
+	}
+
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated == 0 {
+		return fmt.Errorf("No user like this!")
+	}
+
+	return nil
+}
+
+// ClaimVerificationEmail records that a verification email is being sent to
+// the user. It returns false, and records nothing, when the last one went out
+// less than interval ago.
+func (s *UserStore) ClaimVerificationEmail(ctx context.Context, userId int64, interval time.Duration) (bool, error) {
+	query := `UPDATE "user" SET verification_sent_at = CURRENT_TIMESTAMP WHERE id = $1 AND (verification_sent_at IS NULL OR verification_sent_at <= CURRENT_TIMESTAMP - make_interval(secs => $2))`
+	result, err := s.db.ExecContext(ctx, query, userId, interval.Seconds())
+	if err != nil {
+		return false, err
+	}
+
+	claimed, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return claimed == 1, nil
+}
+
+// balanceColumns reads the ledger balance of an account next to the sum of
+// its active holds.
+const balanceColumns = `a.money, COALESCE((SELECT SUM(h.amount) FROM "hold" AS h WHERE h.account_id = a.id AND ` + activeHold + `), 0)`
+
 func (s *UserStore) GetBalance(ctx context.Context, email string) (*types.Balance, error) {
+	query := `SELECT ` + balanceColumns + ` FROM "account" AS a JOIN "user" AS u ON u.id = a.user_id WHERE u.email_index = $1`
+
+	return scanBalance(s.db.QueryRowContext(ctx, query, s.cipher.BlindIndex(fieldUserEmail, email)))
+}
+
+func (s *UserStore) GetUserBalance(ctx context.Context, userId int64) (*types.Balance, error) {
+	query := `SELECT ` + balanceColumns + ` FROM "account" AS a WHERE a.user_id = $1`
+
+	return scanBalance(s.db.QueryRowContext(ctx, query, userId))
+}
+
+func scanBalance(row *sql.Row) (*types.Balance, error) {
 	balance := &types.Balance{}
-	query := `SELECT a.money FROM "account" AS a JOIN "user" AS u ON u.id = a.user_id WHERE u.email = $1`
 
-	if err := s.db.QueryRowContext(ctx, query, email).Scan(
-		&balance.Amount,
+	if err := row.Scan(
+		&balance.Ledger,
+		&balance.Held,
 	); err != nil {
 		return nil, err
 	}
 
+	balance.Amount = int(balance.Ledger)
+	balance.Available = balance.Ledger - balance.Held
 	return balance, nil
 }
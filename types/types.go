@@ -1,19 +1,70 @@
 package types
 
 import (
-	"context"
+	"encoding/json"
 	"time"
 )
 
-type SSEChannel struct {
-	Notifier chan string
-	Clients  []chan string
+// Balance reports the ledger balance of an account, the part of it reserved
+// by holds and what is left to spend. Amount mirrors Ledger for older clients.
+type Balance struct {
+	Amount    int   `json:"amount"`
+	Ledger    int64 `json:"ledger"`
+	Held      int64 `json:"held"`
+	Available int64 `json:"available"`
 }
 
-type Balance struct {
-	Amount int `json:"amount"`
+const (
+	HoldKindCardAuthorization = "card_authorization"
+	HoldKindScheduledTransfer = "scheduled_transfer"
+	HoldKindLoanRepayment     = "loan_repayment"
+)
+
+const (
+	HoldStatusActive   = "active"
+	HoldStatusReleased = "released"
+	HoldStatusConsumed = "consumed"
+)
+
+type Hold struct {
+	Id        int64      `json:"id"`
+	Amount    int64      `json:"amount"`
+	Kind      string     `json:"kind"`
+	Reference string     `json:"reference"`
+	Status    string     `json:"status"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// Envelope is an encrypted payload: the body is sealed with a one-off
+// AES-256-GCM key, which is wrapped with RSA-OAEP-SHA256 for the key named by
+// Kid. Requests are sealed to a server key from the JWKS, responses to the
+// key the client sends in X-Client-Public-Key.
+type Envelope struct {
+	Version    int    `json:"v"`
+	Alg        string `json:"alg"`
+	Kid        string `json:"kid"`
+	WrappedKey string `json:"wrapped_key"`
+	Nonce      string `json:"nonce"`
+	Ciphertext string `json:"ciphertext"`
 }
 
+const (
+	EnvelopeVersion = 1
+	EnvelopeAlg     = "RSA-OAEP-256+A256GCM"
+)
+
+// SealedPayload is what a request envelope's ciphertext holds. The timestamp
+// and client nonce are encrypted with the payload, so a captured envelope can
+// neither be sent again nor have them changed.
+type SealedPayload struct {
+	Timestamp int64           `json:"ts"`
+	Nonce     string          `json:"nonce"`
+	Payload   json.RawMessage `json:"payload"`
+}
+
+// EncryptedDataPayload is the legacy response format, only sent while legacy
+// encryption is on.
 type EncryptedDataPayload struct {
 	Encrypted string `json:"encrypted"`
 	AesKey    string `json:"aesKey"`
@@ -29,6 +80,73 @@ type User struct {
 	EmailVerified  bool   `json:"email_verified"`
 	AccountNumber  string `json:"account_number"`
 	Balance        int32  `json:"balance"`
+	Role           string `json:"role"`
+}
+
+const (
+	RoleUser    = "user"
+	RoleSupport = "support"
+	RoleAdmin   = "admin"
+)
+
+type SetRoleDto struct {
+	Role string `json:"role" validate:"required,oneof=user support admin"`
+}
+
+// AccessClaims are the verified claims of an access token.
+type AccessClaims struct {
+	Email     string
+	SessionId int64
+	TokenId   string
+	Role      string
+}
+
+// AuthTokens are handed out when a user signs in or refreshes their session.
+type AuthTokens struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+// SignInChallenge is returned by sign in instead of tokens when the user has
+// two-factor authentication on. The challenge token and a code are exchanged
+// for tokens at /auth/signin/2fa.
+type SignInChallenge struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	ChallengeToken    string `json:"challenge_token"`
+	ExpiresIn         int    `json:"expires_in"`
+}
+
+type TwoFactorSignInDto struct {
+	ChallengeToken string `json:"challenge_token" validate:"required"`
+	Code           string `json:"code" validate:"required"`
+}
+
+type TotpCodeDto struct {
+	Code string `json:"code" validate:"required"`
+}
+
+type TotpEnrollment struct {
+	Secret          string `json:"secret"`
+	ProvisioningUri string `json:"provisioning_uri"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type ForgotPasswordDto struct {
+	Email string `json:"email" validate:"required,email"`
+}
+
+type ResetPasswordDto struct {
+	Token    string `json:"token" validate:"required"`
+	Password string `json:"password" validate:"required,min=3,max=30"`
+}
+
+type RefreshTokenDto struct {
+	RefreshToken string `json:"refresh_token" validate:"required"`
 }
 
 type LoginPayload struct {
@@ -48,11 +166,94 @@ type RegisterUserPayload struct {
 type BorrowMoneyDto struct {
 	Explanation string `json:"explanation" validate:"required"`
 	Amount      int32  `json:"amount" validate:"required"`
+	TermDays    int32  `json:"term_days" validate:"omitempty,min=7,max=365"`
+}
+
+type RepayLoanDto struct {
+	Amount int32 `json:"amount" validate:"required,gt=0"`
+}
+
+const (
+	LoanStatusActive  = "active"
+	LoanStatusRepaid  = "repaid"
+	LoanStatusOverdue = "overdue"
+)
+
+type Loan struct {
+	Id              int64      `json:"id"`
+	Principal       int64      `json:"principal"`
+	InterestRateBps int32      `json:"interest_rate_bps"`
+	Interest        int64      `json:"interest"`
+	TermDays        int32      `json:"term_days"`
+	Explanation     string     `json:"explanation"`
+	AmountRepaid    int64      `json:"amount_repaid"`
+	Outstanding     int64      `json:"outstanding"`
+	Status          string     `json:"status"`
+	DisbursedAt     time.Time  `json:"disbursed_at"`
+	DueAt           time.Time  `json:"due_at"`
+	RepaidAt        *time.Time `json:"repaid_at"`
 }
 
 type TransferMoneyDto struct {
 	Amount        int32  `json:"amount" validate:"required"`
-	AccountNumber string `json:"account_number" validate:"required"`
+	AccountNumber string `json:"account_number" validate:"required,account_number"`
+	// TotpCode is required for transfers at or above the two-factor threshold.
+	TotpCode string `json:"totp_code"`
+}
+
+type TransferResult struct {
+	TransactionId  int64  `json:"transaction_id"`
+	Amount         int32  `json:"amount"`
+	SenderId       int64  `json:"-"`
+	ReceiverId     int64  `json:"-"`
+	NameOfReceiver string `json:"name_of_receiver"`
+}
+
+const (
+	EventBalanceUpdated   = "balance.updated"
+	EventTransferReceived = "transfer.received"
+	EventTransferSent     = "transfer.sent"
+	EventLoanDisbursed    = "loan.disbursed"
+)
+
+// EventTypes lists every event type a client can subscribe to.
+var EventTypes = []string{EventBalanceUpdated, EventTransferReceived, EventTransferSent, EventLoanDisbursed}
+
+// Event is a realtime account event delivered to a single user's streams.
+type Event struct {
+	Id        uint64          `json:"id"`
+	Type      string          `json:"type"`
+	UserId    int64           `json:"-"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"created_at"`
+}
+
+const (
+	SocketActionSubscribe   = "subscribe"
+	SocketActionUnsubscribe = "unsubscribe"
+)
+
+// SocketMessage is sent by WebSocket clients to choose which event types they
+// receive. Clients get every event until their first message: subscribing
+// narrows the events down to the ones named, unsubscribing leaves out the
+// ones named.
+type SocketMessage struct {
+	Action string   `json:"action" validate:"required,oneof=subscribe unsubscribe"`
+	Events []string `json:"events" validate:"required,min=1,dive,oneof=balance.updated transfer.received transfer.sent loan.disbursed"`
+}
+
+// SocketReply answers a SocketMessage with the client's subscriptions, or
+// with the reason the message was rejected.
+type SocketReply struct {
+	Type    string   `json:"type"`
+	Events  []string `json:"events,omitempty"`
+	Message string   `json:"message,omitempty"`
+}
+
+type TransferEvent struct {
+	TransactionId int64  `json:"transaction_id"`
+	Amount        int32  `json:"amount"`
+	Counterparty  string `json:"counterparty"`
 }
 
 type ReceivedTransactions struct {
@@ -63,8 +264,27 @@ type ReceivedTransactions struct {
 }
 
 type BorrowedTransactions struct {
-	Amount int32     `json:"amount"`
-	SentAt time.Time `json:"sent_at"`
+	Amount       int32      `json:"amount"`
+	SentAt       time.Time  `json:"sent_at"`
+	LoanId       *int64     `json:"loan_id"`
+	AmountRepaid int64      `json:"amount_repaid"`
+	Outstanding  int64      `json:"outstanding"`
+	Status       string     `json:"status"`
+	DueAt        *time.Time `json:"due_at"`
+}
+
+type Borrower struct {
+	BorrowedTransactions
+	UserId    int64  `json:"user_id"`
+	Email     string `json:"email"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+}
+
+type BorrowerFilter struct {
+	From   *time.Time
+	To     *time.Time
+	Status string
 }
 
 type SentTransactions struct {
@@ -74,20 +294,225 @@ type SentTransactions struct {
 	SentAt            time.Time `json:"sent_at"`
 }
 
-type DataPayloadFromTransferDto struct {
-	Id             int8   `json:"id"`
-	RemainingMoney int32  `json:"remaining_money"`
-	Amount         int32  `json:"amount"`
-	NameOfReceiver string `json:"name_of_receiver"`
+const (
+	PostingDebit  = "debit"
+	PostingCredit = "credit"
+)
+
+type Posting struct {
+	LedgerAccountId int64  `json:"ledger_account_id"`
+	Direction       string `json:"direction"`
+	Amount          int64  `json:"amount"`
+}
+
+type JournalEntry struct {
+	Id            int64     `json:"id"`
+	Kind          string    `json:"kind"`
+	Description   string    `json:"description"`
+	TransactionId int64     `json:"transaction_id"`
+	Postings      []Posting `json:"postings"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type LedgerBalance struct {
+	AccountId int64 `json:"account_id"`
+	Cached    int64 `json:"cached"`
+	Derived   int64 `json:"derived"`
+	Corrected bool  `json:"corrected"`
+}
+
+const (
+	CardStatusActive     = "active"
+	CardStatusFrozen     = "frozen"
+	CardStatusTerminated = "terminated"
+)
+
+type Card struct {
+	Id           int64      `json:"id"`
+	MaskedNumber string     `json:"masked_number"`
+	ExpiryMonth  int        `json:"expiry_month"`
+	ExpiryYear   int        `json:"expiry_year"`
+	Status       string     `json:"status"`
+	CreatedAt    time.Time  `json:"created_at"`
+	TerminatedAt *time.Time `json:"terminated_at"`
+}
+
+// IssuedCard is only ever returned once, when the card is created. The full
+// number and CVC cannot be read back afterwards.
+type IssuedCard struct {
+	Card
+	Number string `json:"number"`
+	Cvc    string `json:"cvc"`
+}
+
+type CardAuthorizationDto struct {
+	Number           string `json:"number" validate:"required,numeric,min=12,max=19"`
+	ExpiryMonth      int    `json:"expiry_month" validate:"required,min=1,max=12"`
+	ExpiryYear       int    `json:"expiry_year" validate:"required"`
+	Cvc              string `json:"cvc" validate:"required,numeric,len=3"`
+	Amount           int32  `json:"amount" validate:"required,gt=0"`
+	MerchantName     string `json:"merchant_name" validate:"required,max=100"`
+	MerchantId       string `json:"merchant_id" validate:"max=64"`
+	MerchantCategory string `json:"merchant_category" validate:"omitempty,numeric,len=4"`
+}
+
+type CaptureAuthorizationDto struct {
+	Amount int32 `json:"amount" validate:"omitempty,gt=0"`
+}
+
+const (
+	AuthorizationStatusPending  = "pending"
+	AuthorizationStatusCaptured = "captured"
+	AuthorizationStatusVoided   = "voided"
+)
+
+type CardAuthorization struct {
+	Id               int64     `json:"id"`
+	CardId           int64     `json:"card_id"`
+	Amount           int64     `json:"amount"`
+	CapturedAmount   int64     `json:"captured_amount"`
+	MerchantName     string    `json:"merchant_name"`
+	MerchantId       string    `json:"merchant_id"`
+	MerchantCategory string    `json:"merchant_category"`
+	Status           string    `json:"status"`
+	CreatedAt        time.Time `json:"created_at"`
+	UpdatedAt        time.Time `json:"updated_at"`
 }
 
-type TransferJob struct {
-	Id           int
-	Query        string
-	Args         []interface{}
-	ExecuteQuery func(context.Context, string, []interface{}) error
+// CodedError carries a stable, machine readable code next to the message so
+// the frontend can react to a failure without parsing text.
+type CodedError struct {
+	Code    string
+	Message string
 }
 
+func (e *CodedError) Error() string {
+	return e.Message
+}
+
+const (
+	ReasonInvalidAmount       = "INVALID_AMOUNT"
+	ReasonAccountTooNew       = "ACCOUNT_TOO_NEW"
+	ReasonLoanOverdue         = "LOAN_OVERDUE"
+	ReasonTooManyActiveLoans  = "TOO_MANY_ACTIVE_LOANS"
+	ReasonCreditLimitExceeded = "CREDIT_LIMIT_EXCEEDED"
+)
+
+const (
+	ErrorEmailNotVerified     = "EMAIL_NOT_VERIFIED"
+	ErrorTwoFactorRequired    = "TWO_FACTOR_REQUIRED"
+	ErrorInvalidTwoFactorCode = "INVALID_TWO_FACTOR_CODE"
+	ErrorTooManyAttempts      = "TOO_MANY_ATTEMPTS"
+	ErrorAccountLocked        = "ACCOUNT_LOCKED"
+	ErrorUnknownKey           = "UNKNOWN_KEY"
+	ErrorInvalidPayload       = "INVALID_PAYLOAD"
+	ErrorClientKeyRequired    = "CLIENT_KEY_REQUIRED"
+	ErrorStalePayload         = "STALE_PAYLOAD"
+	ErrorReplayedPayload      = "REPLAYED_PAYLOAD"
+	ErrorEncryptionRequired   = "ENCRYPTION_REQUIRED"
+)
+
+const (
+	DeclineInvalidCard       = "INVALID_CARD"
+	DeclineCardExpired       = "CARD_EXPIRED"
+	DeclineCardFrozen        = "CARD_FROZEN"
+	DeclineCardTerminated    = "CARD_TERMINATED"
+	DeclineInsufficientFunds = "INSUFFICIENT_FUNDS"
+)
+
+type CreditPolicy struct {
+	BaseLimit         int64
+	MonthlyIncrease   int64
+	RepaidLoanBonus   int64
+	LateRepaymentCut  int64
+	MaxLimit          int64
+	MinAccountAgeDays int64
+	MaxActiveLoans    int64
+}
+
+// LoginPolicy sets how sign in failures are throttled. After FreeFailures
+// failed attempts each further one doubles the wait before the next, up to
+// MaxDelaySeconds, and LockoutFailures lock the account for LockoutMinutes.
+// An ip with IPFailureLimit failures in IPWindowMinutes has to wait as well.
+type LoginPolicy struct {
+	FreeFailures    int64
+	MaxDelaySeconds int64
+	LockoutFailures int64
+	LockoutMinutes  int64
+	IPFailureLimit  int64
+	IPWindowMinutes int64
+}
+
+// LoginThrottle says how long a sign in has to wait, in seconds.
+type LoginThrottle struct {
+	Locked     bool
+	RetryAfter int
+}
+
+// LoginAttempt is the audit record of a sign in.
+type LoginAttempt struct {
+	Email     string
+	IP        string
+	UserAgent string
+	Reason    string
+}
+
+type BorrowingHistory struct {
+	AccountAgeDays int64
+	ActiveLoans    int64
+	OverdueLoans   int64
+	Outstanding    int64
+	RepaidLoans    int64
+	LateRepayments int64
+}
+
+type Eligibility struct {
+	Eligible    bool   `json:"eligible"`
+	Reason      string `json:"reason,omitempty"`
+	Message     string `json:"message,omitempty"`
+	CreditLimit int64  `json:"credit_limit"`
+	Outstanding int64  `json:"outstanding"`
+	Available   int64  `json:"available"`
+}
+
+type IdempotencyRecord struct {
+	Key         string
+	RequestHash string
+	Completed   bool
+	StatusCode  int
+	Headers     map[string]string
+	Response    []byte
+}
+
+// DataPayload is the legacy request format, only accepted while legacy
+// encryption is on.
 type DataPayload struct {
 	Data string `json:"data"`
+	// Kid names the key Data was encrypted to. Payloads without one are
+	// tried against every key still accepted.
+	Kid string `json:"kid,omitempty"`
+}
+
+// EncryptionKey is an RSA key pair clients encrypt payloads to. The current
+// key has no RetiresAt; a replaced key keeps working until then so payloads
+// encrypted before the rotation still go through.
+type EncryptionKey struct {
+	Kid        string
+	PrivateKey string
+	CreatedAt  time.Time
+	RetiresAt  *time.Time
+}
+
+// JSONWebKey is the public half of an EncryptionKey in JWK format.
+type JSONWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type JSONWebKeySet struct {
+	Keys []JSONWebKey `json:"keys"`
 }
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// CardIIN is the issuer identification number every ChiFunds card starts with.
+const CardIIN = "539983"
+
+// GenerateCardNumber returns a random 16 digit card number under CardIIN
+// whose last digit is a Luhn check digit.
+func GenerateCardNumber() (string, error) {
+	body, err := RandomDigits(15 - len(CardIIN))
+	if err != nil {
+		return "", err
+	}
+
+	payload := CardIIN + body
+	return fmt.Sprintf("%s%d", payload, LuhnCheckDigit(payload)), nil
+}
+
+// LuhnCheckDigit computes the digit that makes payload followed by it pass
+// the Luhn check.
+func LuhnCheckDigit(payload string) int {
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		digit := int(payload[i] - '0')
+		if (len(payload)-1-i)%2 == 0 {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+	}
+
+	return (10 - sum%10) % 10
+}
+
+func ValidLuhn(number string) bool {
+	if len(number) < 2 || strings.Trim(number, "0123456789") != "" {
+		return false
+	}
+
+	return LuhnCheckDigit(number[:len(number)-1]) == int(number[len(number)-1]-'0')
+}
+
+func MaskCardNumber(number string) string {
+	if len(number) < 4 {
+		return number
+	}
+
+	return "**** **** **** " + number[len(number)-4:]
+}
+
+// RandomDigits returns n digits drawn from crypto/rand.
+func RandomDigits(n int) (string, error) {
+	var digits strings.Builder
+	for i := 0; i < n; i++ {
+		digit, err := rand.Int(rand.Reader, big.NewInt(10))
+		if err != nil {
+			return "", err
+		}
+		digits.WriteString(digit.String())
+	}
+
+	return digits.String(), nil
+}
@@ -0,0 +1,289 @@
+package utils
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+// ClientPublicKeyHeader carries the RSA public key responses are encrypted
+// to, as base64 DER (SPKI, what WebCrypto exports) or PEM.
+const ClientPublicKeyHeader = "X-Client-Public-Key"
+
+// minClientKeyBits is the smallest client key responses are encrypted to.
+const minClientKeyBits = 2048
+
+// Client nonces must be long enough to be unique, and short enough to store.
+const (
+	minNonceLength = 16
+	maxNonceLength = 128
+)
+
+var (
+	errInvalidEnvelope = &types.CodedError{Code: types.ErrorInvalidPayload, Message: "Invalid encrypted payload"}
+	errLegacyPayload   = &types.CodedError{Code: types.ErrorInvalidPayload, Message: fmt.Sprintf("Unencrypted or legacy payloads are not accepted, send a version %d envelope", types.EnvelopeVersion)}
+	errClientKey       = &types.CodedError{Code: types.ErrorClientKeyRequired, Message: fmt.Sprintf("Send the RSA public key to encrypt the response to in the %s header", ClientPublicKeyHeader)}
+	errStalePayload    = &types.CodedError{Code: types.ErrorStalePayload, Message: "The payload is too old or its timestamp is off, check the device clock and encrypt it again"}
+	errReplayedPayload = &types.CodedError{Code: types.ErrorReplayedPayload, Message: "This payload was already sent, encrypt it again with a new nonce"}
+	// Legacy payloads cannot be checked for replays, so routes that move
+	// money refuse them even when they are otherwise accepted.
+	errReplayablePayload = &types.CodedError{Code: types.ErrorInvalidPayload, Message: fmt.Sprintf("Legacy payloads are not accepted here, send a version %d envelope", types.EnvelopeVersion)}
+)
+
+// LegacyEncryption reports whether payloads in the old format are still
+// accepted: a body RSA-PKCS#1 v1.5 encrypted as a whole, and responses
+// wrapped with the server's own key. It is off unless
+// LEGACY_PAYLOAD_ENCRYPTION is true, as PKCS#1 v1.5 decryption can leak
+// enough to break the server key. Legacy payloads have no replay protection,
+// so routes that move money never take them.
+func LegacyEncryption() bool {
+	return os.Getenv("LEGACY_PAYLOAD_ENCRYPTION") == "true"
+}
+
+// PayloadMaxAge is how far a request's timestamp may be from the server's
+// clock, from PAYLOAD_MAX_AGE_SECONDS. Nonces are kept long enough to cover
+// the whole window on either side.
+func PayloadMaxAge() time.Duration {
+	if seconds, err := strconv.Atoi(os.Getenv("PAYLOAD_MAX_AGE_SECONDS")); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	return 5 * time.Minute
+}
+
+// SealEnvelope encrypts plaintext with a fresh AES-256-GCM key and wraps the
+// key with RSA-OAEP-SHA256 for public. The header fields are authenticated
+// along with the ciphertext, so they cannot be swapped.
+func SealEnvelope(public *rsa.PublicKey, kid string, plaintext []byte) (*types.Envelope, error) {
+	envelope := &types.Envelope{Version: types.EnvelopeVersion, Alg: types.EnvelopeAlg, Kid: kid}
+
+	aesKey := make([]byte, 32)
+	if _, err := rand.Read(aesKey); err != nil {
+		return nil, err
+	}
+
+	wrappedKey, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, public, aesKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("key wrapping error: %v", err)
+	}
+
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	envelope.WrappedKey = base64.StdEncoding.EncodeToString(wrappedKey)
+	envelope.Nonce = base64.StdEncoding.EncodeToString(nonce)
+	envelope.Ciphertext = base64.StdEncoding.EncodeToString(gcm.Seal(nil, nonce, plaintext, envelopeAAD(envelope)))
+
+	return envelope, nil
+}
+
+// OpenEnvelope decrypts an envelope sealed to private's public key.
+func OpenEnvelope(private *rsa.PrivateKey, envelope types.Envelope) ([]byte, error) {
+	if envelope.Version != types.EnvelopeVersion || envelope.Alg != types.EnvelopeAlg {
+		return nil, errInvalidEnvelope
+	}
+
+	wrappedKey, err := base64.StdEncoding.DecodeString(envelope.WrappedKey)
+	if err != nil {
+		return nil, errInvalidEnvelope
+	}
+	nonce, err := base64.StdEncoding.DecodeString(envelope.Nonce)
+	if err != nil {
+		return nil, errInvalidEnvelope
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope.Ciphertext)
+	if err != nil {
+		return nil, errInvalidEnvelope
+	}
+
+	aesKey, err := rsa.DecryptOAEP(sha256.New(), nil, private, wrappedKey, nil)
+	if err != nil || len(aesKey) != 32 {
+		return nil, errInvalidEnvelope
+	}
+
+	gcm, err := newGCM(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, errInvalidEnvelope
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, envelopeAAD(&envelope))
+	if err != nil {
+		return nil, errInvalidEnvelope
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("AES cipher creation error: %v", err)
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func envelopeAAD(envelope *types.Envelope) []byte {
+	return []byte(fmt.Sprintf("%d.%s.%s", envelope.Version, envelope.Alg, envelope.Kid))
+}
+
+// ClientPublicKey reads the key the response should be encrypted to. It is
+// nil when the client sent none and legacy encryption is allowed.
+func ClientPublicKey(r *http.Request) (*rsa.PublicKey, error) {
+	header := strings.TrimSpace(r.Header.Get(ClientPublicKeyHeader))
+	if header == "" {
+		if LegacyEncryption() {
+			return nil, nil
+		}
+		return nil, errClientKey
+	}
+
+	var der []byte
+	if block, _ := pem.Decode([]byte(header)); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(header); err == nil {
+		der = decoded
+	} else {
+		return nil, errClientKey
+	}
+
+	var public *rsa.PublicKey
+	if parsed, err := x509.ParsePKIXPublicKey(der); err == nil {
+		public, _ = parsed.(*rsa.PublicKey)
+	} else if parsed, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		public = parsed
+	}
+
+	if public == nil || public.N.BitLen() < minClientKeyBits {
+		return nil, errClientKey
+	}
+
+	return public, nil
+}
+
+// KeyThumbprint is the RFC 7638 thumbprint of an RSA public key, which is
+// used as its kid.
+func KeyThumbprint(public *rsa.PublicKey) string {
+	members, _ := json.Marshal(struct {
+		E   string `json:"e"`
+		Kty string `json:"kty"`
+		N   string `json:"n"`
+	}{
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes()),
+		Kty: "RSA",
+		N:   base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+	})
+
+	sum := sha256.Sum256(members)
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// decodePayload tells envelopes from the legacy format, which is only
+// accepted when LegacyEncryption is on.
+func decodePayload(body []byte) (*types.Envelope, *types.DataPayload, error) {
+	var envelope types.Envelope
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, nil, err
+	}
+
+	if envelope.Version != 0 {
+		return &envelope, nil, nil
+	}
+
+	if !LegacyEncryption() {
+		return nil, nil, errLegacyPayload
+	}
+
+	var payload types.DataPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil, nil, err
+	}
+	if payload.Data == "" {
+		return nil, nil, errors.New("Missing body data")
+	}
+
+	return nil, &payload, nil
+}
+
+// PeekPayload returns the payload a request body carries without checking
+// its timestamp or claiming its nonce, so a payload that was encrypted again
+// can be recognised. Only DecryptAndParseJson accepts a payload.
+func PeekPayload(body []byte, keys PayloadKeys) ([]byte, error) {
+	envelope, legacy, err := decodePayload(body)
+	if err != nil {
+		return nil, err
+	}
+
+	if legacy != nil {
+		return keys.RsaDecrypt(legacy.Kid, legacy.Data)
+	}
+
+	plaintext, err := keys.Open(*envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	var sealed types.SealedPayload
+	if err := json.Unmarshal(plaintext, &sealed); err != nil {
+		return nil, errInvalidEnvelope
+	}
+
+	return sealed.Payload, nil
+}
+
+// openSealedPayload checks the timestamp and nonce a request was sealed with
+// and returns the payload. The nonce is claimed last, so a stale payload does
+// not use it up.
+func openSealedPayload(ctx context.Context, plaintext []byte, nonces NonceCache) ([]byte, error) {
+	var sealed types.SealedPayload
+	if err := json.Unmarshal(plaintext, &sealed); err != nil {
+		return nil, errInvalidEnvelope
+	}
+
+	if len(sealed.Nonce) < minNonceLength || len(sealed.Nonce) > maxNonceLength || len(sealed.Payload) == 0 {
+		return nil, errInvalidEnvelope
+	}
+
+	maxAge := PayloadMaxAge()
+	age := time.Since(time.Unix(sealed.Timestamp, 0))
+	if age > maxAge || age < -maxAge {
+		return nil, errStalePayload
+	}
+
+	claimed, err := nonces.ClaimNonce(ctx, sealed.Nonce, 2*maxAge)
+	if err != nil {
+		return nil, err
+	}
+	if !claimed {
+		return nil, errReplayedPayload
+	}
+
+	return sealed.Payload, nil
+}
@@ -0,0 +1,188 @@
+package utils
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/brownei/chifunds-api/types"
+)
+
+func TestEnvelope(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kid := KeyThumbprint(&private.PublicKey)
+	plaintext := []byte(`{"amount":5000,"account_number":"0123456789"}`)
+
+	tests := []struct {
+		name   string
+		key    *rsa.PrivateKey
+		tamper func(envelope *types.Envelope)
+		ok     bool
+	}{
+		{name: "round trip", key: private, tamper: func(*types.Envelope) {}, ok: true},
+		{name: "other key", key: other, tamper: func(*types.Envelope) {}},
+		{name: "kid changed", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.Kid = KeyThumbprint(&other.PublicKey)
+		}},
+		{name: "kid removed", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.Kid = ""
+		}},
+		{name: "version changed", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.Version = types.EnvelopeVersion + 1
+		}},
+		{name: "alg changed", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.Alg = "RSA-OAEP+A256GCM"
+		}},
+		{name: "ciphertext changed", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.Ciphertext = flipFirstBit(t, envelope.Ciphertext)
+		}},
+		{name: "nonce changed", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.Nonce = flipFirstBit(t, envelope.Nonce)
+		}},
+		{name: "wrapped key changed", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.WrappedKey = flipFirstBit(t, envelope.WrappedKey)
+		}},
+		{name: "ciphertext not base64", key: private, tamper: func(envelope *types.Envelope) {
+			envelope.Ciphertext = "not base64!"
+		}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			envelope, err := SealEnvelope(&private.PublicKey, kid, plaintext)
+			if err != nil {
+				t.Fatalf("SealEnvelope: %v", err)
+			}
+			test.tamper(envelope)
+
+			opened, err := OpenEnvelope(test.key, *envelope)
+			if test.ok {
+				if err != nil {
+					t.Fatalf("OpenEnvelope: %v", err)
+				}
+				if !bytes.Equal(opened, plaintext) {
+					t.Fatalf("OpenEnvelope = %q, want %q", opened, plaintext)
+				}
+				return
+			}
+
+			if err != errInvalidEnvelope {
+				t.Fatalf("OpenEnvelope error = %v, want %v", err, errInvalidEnvelope)
+			}
+		})
+	}
+}
+
+func TestSealEnvelopeIsRandomized(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, err := SealEnvelope(&private.PublicKey, "kid", []byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := SealEnvelope(&private.PublicKey, "kid", []byte("same"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if first.Ciphertext == second.Ciphertext || first.WrappedKey == second.WrappedKey {
+		t.Fatal("sealing the same plaintext twice gave the same envelope")
+	}
+}
+
+func flipFirstBit(t *testing.T, encoded string) string {
+	t.Helper()
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded[0] ^= 1
+
+	return base64.StdEncoding.EncodeToString(decoded)
+}
+
+// envelopeKeys opens envelopes with a single private key.
+type envelopeKeys struct {
+	private *rsa.PrivateKey
+}
+
+func (k envelopeKeys) Open(envelope types.Envelope) ([]byte, error) {
+	return OpenEnvelope(k.private, envelope)
+}
+
+func (k envelopeKeys) RsaDecrypt(kid string, data string) ([]byte, error) {
+	return nil, errInvalidEnvelope
+}
+
+func (k envelopeKeys) RsaEncrypt(data []byte) (string, string, error) {
+	return "", "", errInvalidEnvelope
+}
+
+func TestPeekPayloadIgnoresNonceAndTimestamp(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := envelopeKeys{private}
+	payload := []byte(`{"amount":5000}`)
+
+	seal := func(nonce string, timestamp int64) []byte {
+		t.Helper()
+
+		sealed, err := json.Marshal(types.SealedPayload{Timestamp: timestamp, Nonce: nonce, Payload: payload})
+		if err != nil {
+			t.Fatal(err)
+		}
+		envelope, err := SealEnvelope(&private.PublicKey, KeyThumbprint(&private.PublicKey), sealed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := json.Marshal(envelope)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return body
+	}
+
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{name: "first encryption", body: seal("first-nonce-0123456789", time.Now().Unix())},
+		{name: "encrypted again", body: seal("second-nonce-0123456789", time.Now().Unix())},
+		{name: "stale", body: seal("third-nonce-0123456789", 0)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			peeked, err := PeekPayload(test.body, keys)
+			if err != nil {
+				t.Fatalf("PeekPayload: %v", err)
+			}
+			if !bytes.Equal(peeked, payload) {
+				t.Fatalf("PeekPayload = %q, want %q", peeked, payload)
+			}
+		})
+	}
+
+	if _, err := PeekPayload([]byte(`{"v":1}`), keys); err == nil {
+		t.Fatal("PeekPayload opened an envelope without a key")
+	}
+}
@@ -0,0 +1,102 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// rfc6238Secret is the SHA-1 secret of the RFC 6238 test vectors,
+// "12345678901234567890", base32 encoded.
+const rfc6238Secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestTOTPCode(t *testing.T) {
+	// The RFC lists eight digit codes, these are their last six digits.
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+		{unix: 20000000000, code: "353130"},
+	}
+
+	for _, test := range tests {
+		code, err := TOTPCode(rfc6238Secret, TOTPCounter(time.Unix(test.unix, 0)))
+		if err != nil {
+			t.Fatalf("TOTPCode at %d: %v", test.unix, err)
+		}
+		if code != test.code {
+			t.Errorf("TOTPCode at %d = %s, want %s", test.unix, code, test.code)
+		}
+	}
+}
+
+func TestValidTOTP(t *testing.T) {
+	// The code of the period starting at 1111111110 is accepted from the
+	// start of the period before it to the end of the period after it.
+	const counter = 1111111110 / totpPeriod
+	code, err := TOTPCode(rfc6238Secret, counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := int64(counter * totpPeriod)
+	tests := []struct {
+		name string
+		unix int64
+		code string
+		ok   bool
+	}{
+		{name: "same period", unix: start, code: code, ok: true},
+		{name: "end of period", unix: start + totpPeriod - 1, code: code, ok: true},
+		{name: "start of previous period", unix: start - totpPeriod, code: code, ok: true},
+		{name: "before previous period", unix: start - totpPeriod - 1, code: code},
+		{name: "end of next period", unix: start + 2*totpPeriod - 1, code: code, ok: true},
+		{name: "after next period", unix: start + 2*totpPeriod, code: code},
+		{name: "surrounding spaces", unix: start, code: " " + code + " ", ok: true},
+		{name: "wrong code", unix: start, code: "000000"},
+		{name: "too short", unix: start, code: code[:5]},
+		{name: "too long", unix: start, code: code + "0"},
+		{name: "empty", unix: start, code: ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			matched, ok := ValidTOTP(rfc6238Secret, test.code, time.Unix(test.unix, 0))
+			if ok != test.ok {
+				t.Fatalf("ValidTOTP = %v, want %v", ok, test.ok)
+			}
+			if ok && matched != counter {
+				t.Fatalf("ValidTOTP matched counter %d, want %d", matched, counter)
+			}
+		})
+	}
+}
+
+func TestValidTOTPRejectsInvalidSecret(t *testing.T) {
+	if _, ok := ValidTOTP("not base32!", "123456", time.Now()); ok {
+		t.Fatal("ValidTOTP accepted a code for an invalid secret")
+	}
+}
+
+func TestNormalizeRecoveryCode(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{code: "k3m9q-x7d2p", want: "k3m9q-x7d2p"},
+		{code: "K3M9Q-X7D2P", want: "k3m9q-x7d2p"},
+		{code: "k3m9qx7d2p", want: "k3m9q-x7d2p"},
+		{code: "k3m9q x7d2p", want: "k3m9q-x7d2p"},
+		{code: "k3m9q", want: "k3m9q"},
+	}
+
+	for _, test := range tests {
+		if got := NormalizeRecoveryCode(test.code); got != test.want {
+			t.Errorf("NormalizeRecoveryCode(%q) = %q, want %q", test.code, got, test.want)
+		}
+	}
+}
@@ -3,11 +3,16 @@ package utils
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
 	"net/http"
 	"os"
 	"time"
@@ -38,36 +43,88 @@ func ParseJSON(r *http.Request, payload any) error {
 	return json.NewDecoder(r.Body).Decode(payload)
 }
 
-func DecryptAndParseJson(r *http.Request, decryptFunc func(string) ([]byte, error)) ([]byte, error) {
-	var payload types.DataPayload
+// PayloadKeys decrypts requests with the server's keys. The Rsa methods
+// handle the legacy format while LegacyEncryption is on.
+type PayloadKeys interface {
+	Open(envelope types.Envelope) ([]byte, error)
+	RsaDecrypt(kid string, data string) ([]byte, error)
+	RsaEncrypt(data []byte) (string, string, error)
+}
+
+// NonceCache remembers the nonces of requests seen recently.
+type NonceCache interface {
+	ClaimNonce(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+// DecryptAndParseJson decrypts the request body and returns the payload it
+// carries, refusing payloads that are stale or were already sent. It also
+// checks the client sent a key to encrypt the response to, so a request is
+// refused before any work is done rather than after. Legacy payloads carry no
+// timestamp or nonce, so they are only taken when allowLegacy is set.
+func DecryptAndParseJson(r *http.Request, keys PayloadKeys, nonces NonceCache, allowLegacy bool) ([]byte, error) {
 	if r.Body == nil {
 		log.Printf("Missing body data")
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+	if _, err := ClientPublicKey(r); err != nil {
+		return nil, err
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
 		return nil, err
 	}
 
-	decryptedData, err := decryptFunc(payload.Data)
+	envelope, legacy, err := decodePayload(body)
 	if err != nil {
 		return nil, err
 	}
 
-	return decryptedData, nil
+	if legacy != nil {
+		if !allowLegacy {
+			return nil, errReplayablePayload
+		}
+		return keys.RsaDecrypt(legacy.Kid, legacy.Data)
+	}
+
+	plaintext, err := keys.Open(*envelope)
+	if err != nil {
+		return nil, err
+	}
+
+	return openSealedPayload(r.Context(), plaintext, nonces)
 }
 
-func EncryptAndWriteJson(w http.ResponseWriter, status int, byteTrans []byte, encryptFunc func([]byte) (string, string, error)) {
-	encrypted, key, err := encryptFunc(byteTrans)
+// EncryptAndWriteJson encrypts the response to the client's public key.
+// Without one it falls back to the legacy format when that is allowed.
+func EncryptAndWriteJson(w http.ResponseWriter, r *http.Request, status int, byteTrans []byte, keys PayloadKeys) {
+	public, err := ClientPublicKey(r)
 	if err != nil {
-		WriteError(w, http.StatusBadGateway, err)
+		WriteError(w, http.StatusBadRequest, err)
+		return
 	}
 
-	payload := types.EncryptedDataPayload{
-		Encrypted: encrypted,
-		AesKey:    key,
+	if public == nil {
+		encrypted, key, err := keys.RsaEncrypt(byteTrans)
+		if err != nil {
+			WriteError(w, http.StatusBadGateway, err)
+			return
+		}
+
+		WriteJSON(w, status, types.EncryptedDataPayload{
+			Encrypted: encrypted,
+			AesKey:    key,
+		})
+		return
 	}
 
-	WriteJSON(w, status, payload)
+	envelope, err := SealEnvelope(public, KeyThumbprint(public), byteTrans)
+	if err != nil {
+		WriteError(w, http.StatusBadGateway, err)
+		return
+	}
+
+	WriteJSON(w, status, envelope)
 }
 
 func WriteJSON(w http.ResponseWriter, status int, v any) error {
@@ -78,31 +135,39 @@ func WriteJSON(w http.ResponseWriter, status int, v any) error {
 }
 
 func WriteError(w http.ResponseWriter, status int, err error) {
+	var codedErr *types.CodedError
+	if errors.As(err, &codedErr) {
+		WriteJSON(w, status, map[string]string{"error": codedErr.Message, "code": codedErr.Code})
+		return
+	}
+
 	WriteJSON(w, status, map[string]string{"error": err.Error()})
 }
 
-func RandomAccountNumber() string {
-	rand := 1000000 + rand.Intn(9999999-1000000)
-	return fmt.Sprintf("512%d", rand)
-}
+// AccessTokenTTL is how long an access token is valid. Clients get a new one
+// from their refresh token once it expires.
+const AccessTokenTTL = 15 * time.Minute
 
-func JwtToken(email string, ctx context.Context) string {
+// AccessToken signs a short lived token for the user's session. The session
+// id lets the token be revoked before it expires. The role is read at sign in
+// and refresh, so a role change reaches the token within AccessTokenTTL.
+func AccessToken(email string, sessionId int64, role string) (string, error) {
 	var secretKey = []byte(os.Getenv("SECRET_KEY"))
-	expiryTime := time.Now().Add(7 * 24 * time.Hour).Unix() // 7 days in seconds
+	now := time.Now()
 	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"sub": email,      // Subject (user identifier)
-		"iss": "chifunds", // Issuer
-		"exp": expiryTime,
-		"iat": time.Now().Unix(), // Issued at
+		"sub":  email,      // Subject (user identifier)
+		"iss":  "chifunds", // Issuer
+		"sid":  sessionId,  // Session the token belongs to
+		"role": role,       // Role at the time the token was issued
+		"jti":  RandomToken(16),
+		"exp":  now.Add(AccessTokenTTL).Unix(),
+		"iat":  now.Unix(), // Issued at
 	})
 
-	token, _ := claims.SignedString(secretKey)
-	// Print information about the created token
-	fmt.Printf("Token claims added: %+v\n", token)
-	return token
+	return claims.SignedString(secretKey)
 }
 
-func VerifyToken(token string) (string, error) {
+func VerifyToken(token string) (*types.AccessClaims, error) {
 	var secretKey = []byte(os.Getenv("SECRET_KEY"))
 	verifiedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
 		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
@@ -112,21 +177,97 @@ func VerifyToken(token string) (string, error) {
 		return secretKey, nil
 	})
 	if err != nil {
-		return "", fmt.Errorf("Error in the verified token: %s\n%v", err.Error(), verifiedToken)
+		return nil, fmt.Errorf("Error in the verified token: %s", err.Error())
 	}
 
 	// Check if the token is valid
 	if !verifiedToken.Valid {
-		return "", fmt.Errorf("Not Valid!", err.Error())
+		return nil, fmt.Errorf("Not Valid!")
 	}
 
-	email, _ := verifiedToken.Claims.GetSubject()
-	// Return the verified token
-	log.Printf("VerifiedToken: %v\n", email)
+	claims, ok := verifiedToken.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("Not Valid!")
+	}
 
+	// Tokens issued before sessions existed carry no session and can no
+	// longer be used.
+	sessionId, ok := claims["sid"].(float64)
+	if !ok {
+		return nil, fmt.Errorf("Session has expired, sign in again")
+	}
+
+	email, _ := claims.GetSubject()
+	jti, _ := claims["jti"].(string)
+	role, _ := claims["role"].(string)
+	if role == "" {
+		role = types.RoleUser
+	}
+
+	return &types.AccessClaims{Email: email, SessionId: int64(sessionId), TokenId: jti, Role: role}, nil
+}
+
+// PurposeToken signs a token that proves control of the email for a single
+// purpose, such as verifying it. It cannot be used as an access token.
+func PurposeToken(email string, purpose string, ttl time.Duration) (string, error) {
+	var secretKey = []byte(os.Getenv("SECRET_KEY"))
+	now := time.Now()
+	claims := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"sub": email,
+		"iss": "chifunds",
+		"pur": purpose,
+		"exp": now.Add(ttl).Unix(),
+		"iat": now.Unix(),
+	})
+
+	return claims.SignedString(secretKey)
+}
+
+// VerifyPurposeToken returns the email of a token signed by PurposeToken for
+// the same purpose.
+func VerifyPurposeToken(token string, purpose string) (string, error) {
+	var secretKey = []byte(os.Getenv("SECRET_KEY"))
+	verifiedToken, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		return secretKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer("chifunds"))
+	if err != nil || !verifiedToken.Valid {
+		return "", fmt.Errorf("Invalid or expired token")
+	}
+
+	claims, ok := verifiedToken.Claims.(jwt.MapClaims)
+	if !ok || claims["pur"] != purpose {
+		return "", fmt.Errorf("Invalid or expired token")
+	}
+
+	email, _ := claims.GetSubject()
 	return email, nil
 }
 
+// NewSecretToken returns a random token, such as a refresh token, and the hash
+// it is stored under. Only the hash is kept, so a leaked table cannot be used
+// to sign in.
+func NewSecretToken() (string, string) {
+	token := RandomToken(32)
+	return token, HashToken(token)
+}
+
+// RandomToken returns n random bytes encoded for use in URLs.
+func RandomToken(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		// crypto/rand only fails when the system has no entropy source.
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// HashToken is the SHA-256 hex digest of a token.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
 func StructToBytes(data any) ([]byte, error) {
 	var buf bytes.Buffer
 	enc := gob.NewEncoder(&buf)